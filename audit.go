@@ -0,0 +1,190 @@
+package sqlds
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// AuditQueries are the statements needed to keep the audit log in a table
+// next to the blocks table
+type AuditQueries interface {
+	// RecordAudit inserts an event with op ($1), key ($2), size ($3) and
+	// caller ($4) at time $5
+	RecordAudit() string
+}
+
+// AuditOp is the kind of operation recorded in the audit log
+type AuditOp string
+
+const (
+	// AuditPut records a Put, in a batch or not
+	AuditPut AuditOp = "put"
+	// AuditDelete records a Delete, in a batch or not
+	AuditDelete AuditOp = "delete"
+	// AuditUndelete records an Undelete
+	AuditUndelete AuditOp = "undelete"
+	// AuditPurge records PurgeDeleted removing deleted rows for good
+	AuditPurge AuditOp = "purge"
+	// AuditCommit records a batch being committed
+	AuditCommit AuditOp = "commit"
+)
+
+// AuditEvent is an entry of the audit log
+type AuditEvent struct {
+	Op AuditOp
+	// Key is empty for commits and purges
+	Key ds.Key
+	// Size is the size of the value for puts and undeletes, the number of
+	// operations for commits, the number of rows removed for purges, and
+	// 0 for deletes
+	Size   int64
+	Caller string
+	Time   time.Time
+}
+
+// AuditSink receives audit events once the writes they describe have been
+// committed
+type AuditSink interface {
+	Record(ev AuditEvent) error
+}
+
+// AuditConfig configures the audit log
+type AuditConfig struct {
+	// Sink receives the events. If nil, they are written to the audit
+	// table in the transaction of the write they describe, and the
+	// Datastore's Queries must implement AuditQueries.
+	Sink AuditSink
+	// Identity returns the caller a context belongs to. CallerFrom is used
+	// if it is nil.
+	Identity func(ctx context.Context) string
+}
+
+type audit struct {
+	cfg AuditConfig
+}
+
+// WithAudit records every Put, every Delete that removes a key, every
+// Undelete and PurgeDeleted, every write in a batch and every batch commit
+// in an audit log, along with the caller carried by the context of the
+// write. Writes made through a Datastore directly have no
+// context; use WithContext to attribute them.
+func WithAudit(cfg AuditConfig) Option {
+	return func(d *Datastore) {
+		d.audit = &audit{cfg: cfg}
+	}
+}
+
+type callerKey struct{}
+
+// WithCaller returns a context that attributes the writes made with it to
+// caller
+func WithCaller(ctx context.Context, caller string) context.Context {
+	return context.WithValue(ctx, callerKey{}, caller)
+}
+
+// CallerFrom returns the caller set with WithCaller, or ""
+func CallerFrom(ctx context.Context) string {
+	caller, _ := ctx.Value(callerKey{}).(string)
+	return caller
+}
+
+// ContextDatastore is a Datastore whose writes are made with a context, so
+// that the audit log can tell who made them
+type ContextDatastore struct {
+	*Datastore
+	ctx context.Context
+}
+
+// WithContext returns a view of d whose Put, Delete, Undelete,
+// PurgeDeleted and batches are made with ctx. It shares everything else
+// with d.
+func (d *Datastore) WithContext(ctx context.Context) *ContextDatastore {
+	return &ContextDatastore{Datastore: d, ctx: ctx}
+}
+
+func (c *ContextDatastore) Put(key ds.Key, value []byte) error {
+	return c.Datastore.putContext(c.ctx, key, value)
+}
+
+func (c *ContextDatastore) Delete(key ds.Key) error {
+	return c.Datastore.deleteContext(c.ctx, key)
+}
+
+func (c *ContextDatastore) Batch() (ds.Batch, error) {
+	return &batch{ds: c.Datastore, ctx: c.ctx}, nil
+}
+
+func (c *ContextDatastore) Undelete(key ds.Key) error {
+	return c.Datastore.undeleteContext(c.ctx, key)
+}
+
+func (c *ContextDatastore) PurgeDeleted(before time.Time) (int64, error) {
+	return c.Datastore.purgeDeletedContext(c.ctx, before)
+}
+
+var _ ds.Batching = (*ContextDatastore)(nil)
+
+func (d *Datastore) auditEvent(ctx context.Context, op AuditOp, key ds.Key, size int64) AuditEvent {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	identity := d.audit.cfg.Identity
+	if identity == nil {
+		identity = CallerFrom
+	}
+
+	return AuditEvent{
+		Op:     op,
+		Key:    key,
+		Size:   size,
+		Caller: identity(ctx),
+		Time:   time.Now().UTC(),
+	}
+}
+
+// recordAudit writes ev to the audit table when the log has no sink
+func (d *Datastore) recordAudit(e execer, ev AuditEvent) error {
+	if d.audit == nil || d.audit.cfg.Sink != nil {
+		return nil
+	}
+
+	aq, ok := d.queries.(AuditQueries)
+	if !ok {
+		return fmt.Errorf("sqlds: %T does not support an audit table", d.queries)
+	}
+
+	_, err := e.Exec(aq.RecordAudit(), string(ev.Op), ev.Key.String(), ev.Size, ev.Caller, ev.Time)
+	return err
+}
+
+// emitAudit hands committed events to the sink, if the log has one. The
+// writes have happened already, so failures are only logged.
+func (d *Datastore) emitAudit(evs ...AuditEvent) {
+	if d.audit == nil || d.audit.cfg.Sink == nil {
+		return
+	}
+
+	for _, ev := range evs {
+		if err := d.audit.cfg.Sink.Record(ev); err != nil {
+			log.Printf("sqlds: recording audit event for %s of %s: %s", ev.Op, ev.Key, err)
+		}
+	}
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,248 @@
+package sqlds_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	sqlds "github.com/whyrusleeping/sql-datastore"
+	"github.com/whyrusleeping/sql-datastore/postgres"
+)
+
+func auditLog(t *testing.T, d *sqlds.Datastore) []string {
+	rows, err := d.DB().Query("SELECT op, key, size, caller FROM block_audit ORDER BY seq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var log []string
+	for rows.Next() {
+		var op, key, caller string
+		var size int64
+		if err := rows.Scan(&op, &key, &size, &caller); err != nil {
+			t.Fatal(err)
+		}
+		log = append(log, fmt.Sprintf("%s %s %d %s", op, key, size, caller))
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return log
+}
+
+func TestAuditTable(t *testing.T) {
+	d, done := newDS(t, sqlds.WithAudit(sqlds.AuditConfig{}))
+	defer done()
+
+	alice := d.WithContext(sqlds.WithCaller(context.Background(), "alice"))
+	if err := alice.Put(ds.NewKey("/a"), []byte("12345")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put(ds.NewKey("/b"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.Delete(ds.NewKey("/a")); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := d.WithContext(sqlds.WithCaller(context.Background(), "bob")).Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put(ds.NewKey("/c"), []byte("123")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Delete(ds.NewKey("/b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"put /a 5 alice",
+		"put /b 1 ",
+		"delete /a 0 alice",
+		"put /c 3 bob",
+		"delete /b 0 bob",
+		"commit  2 bob",
+	}
+	if got := auditLog(t, d); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected audit log:\n%s", strings.Join(got, "\n"))
+	}
+}
+
+type auditRecorder struct {
+	events []sqlds.AuditEvent
+}
+
+func (r *auditRecorder) Record(ev sqlds.AuditEvent) error {
+	r.events = append(r.events, ev)
+	return nil
+}
+
+func TestAuditSink(t *testing.T) {
+	sink := &auditRecorder{}
+	d, done := newDS(t, sqlds.WithAudit(sqlds.AuditConfig{
+		Sink: sink,
+		Identity: func(ctx context.Context) string {
+			return "user:" + sqlds.CallerFrom(ctx)
+		},
+	}))
+	defer done()
+
+	carol := d.WithContext(sqlds.WithCaller(context.Background(), "carol"))
+	if err := carol.Put(ds.NewKey("/a"), []byte("123")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the batch fails, its writes never happened and are not reported
+	b, err := carol.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put(ds.NewKey("/b"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put(ds.NewKey("/c"), nil); err != ds.ErrInvalidType {
+		t.Fatal("expected ErrInvalidType, got", err)
+	}
+	sqlds.RollbackBatch(b)
+
+	if err := carol.Delete(ds.NewKey("/a")); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sink.events) != 2 {
+		t.Fatalf("expected 2 events, got %v", sink.events)
+	}
+	for i, op := range []sqlds.AuditOp{sqlds.AuditPut, sqlds.AuditDelete} {
+		ev := sink.events[i]
+		if ev.Op != op || ev.Key != ds.NewKey("/a") || ev.Caller != "user:carol" || ev.Time.IsZero() {
+			t.Fatalf("unexpected event %d: %+v", i, ev)
+		}
+	}
+	if sink.events[0].Size != 3 {
+		t.Fatal("expected the size of the value, got", sink.events[0].Size)
+	}
+
+	// the sink keeps nothing in the database
+	var n int
+	err = d.DB().QueryRow("SELECT count(*) FROM block_audit").Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatal("events written to the table with a sink:", n)
+	}
+}
+
+func TestAuditRollback(t *testing.T) {
+	d, done := newDS(t, sqlds.WithAudit(sqlds.AuditConfig{}))
+	defer done()
+
+	if err := d.Put(ds.NewKey("/a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	failing := sqlds.NewDatastore(d.DB(), failingAudit{}, sqlds.WithAudit(sqlds.AuditConfig{}))
+	if err := failing.Put(ds.NewKey("/b"), []byte("1")); err == nil {
+		t.Fatal("expected the write to fail with the audit")
+	}
+
+	if _, err := d.Get(ds.NewKey("/b")); err != ds.ErrNotFound {
+		t.Fatal("a write that could not be audited was kept:", err)
+	}
+	if got := auditLog(t, d); len(got) != 1 {
+		t.Fatalf("unexpected audit log: %v", got)
+	}
+}
+
+// failingAudit cannot write the audit log
+type failingAudit struct {
+	postgres.Queries
+}
+
+func (failingAudit) RecordAudit() string {
+	return `INSERT INTO block_audit_missing (op) VALUES ($1)`
+}
+
+var errAudit = errors.New("audit unavailable")
+
+type failingSink struct{}
+
+func (failingSink) Record(sqlds.AuditEvent) error {
+	return errAudit
+}
+
+func TestAuditSinkFailure(t *testing.T) {
+	d, done := newDS(t, sqlds.WithAudit(sqlds.AuditConfig{Sink: failingSink{}}))
+	defer done()
+
+	// the write is committed before the sink sees it, so it stands
+	if err := d.Put(ds.NewKey("/a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Get(ds.NewKey("/a")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuditSoftDelete(t *testing.T) {
+	d, done := newDS(t, sqlds.WithAudit(sqlds.AuditConfig{}), sqlds.WithSoftDelete(sqlds.SoftDeleteConfig{}))
+	defer done()
+
+	alice := d.WithContext(sqlds.WithCaller(context.Background(), "alice"))
+	if err := alice.Delete(ds.NewKey("/missing")); err != ds.ErrNotFound {
+		t.Fatal("expected ErrNotFound, got", err)
+	}
+	if err := alice.Put(ds.NewKey("/a"), []byte("12345")); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.Delete(ds.NewKey("/a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.Undelete(ds.NewKey("/a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.Delete(ds.NewKey("/a")); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := alice.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Delete(ds.NewKey("/missing")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if purged, err := alice.PurgeDeleted(time.Now().Add(time.Second)); err != nil || purged != 1 {
+		t.Fatalf("expected 1 row purged, got %d: %v", purged, err)
+	}
+	// nothing left to purge, nothing to record
+	if _, err := alice.PurgeDeleted(time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"put /a 5 alice",
+		"delete /a 0 alice",
+		"undelete /a 5 alice",
+		"delete /a 0 alice",
+		"commit  0 alice",
+		"purge  1 alice",
+	}
+	if got := auditLog(t, d); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected audit log:\n%s", strings.Join(got, "\n"))
+	}
+}
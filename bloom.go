@@ -0,0 +1,237 @@
+package sqlds
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// KeysQueries is implemented by dialects that can list keys without
+// reading values.
+type KeysQueries interface {
+	// Keys selects every key in the table
+	Keys() string
+}
+
+// BloomConfig configures the negative-lookup bloom filter
+type BloomConfig struct {
+	// ExpectedKeys sizes the filter; it should exceed the number of keys
+	// the table will hold before the next rebuild
+	ExpectedKeys int
+	// FalsePositiveRate is the target rate at ExpectedKeys
+	FalsePositiveRate float64
+	// RebuildInterval, if set, periodically rebuilds the filter from the
+	// table so that deleted keys stop matching
+	RebuildInterval time.Duration
+}
+
+// DefaultBloomConfig suits a repo of a few million blocks
+var DefaultBloomConfig = BloomConfig{
+	ExpectedKeys:      4 << 20,
+	FalsePositiveRate: 0.01,
+	RebuildInterval:   6 * time.Hour,
+}
+
+type bloomFilter struct {
+	bits []uint64
+	m    uint64
+	k    int
+}
+
+func newBloomFilter(n int, p float64) *bloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	if p <= 0 || p >= 1 {
+		p = 0.01
+	}
+
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	k := int(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+
+	return &bloomFilter{
+		bits: make([]uint64, (m+63)/64),
+		m:    m,
+		k:    k,
+	}
+}
+
+// locations derives k bit positions from two hashes of key
+func (f *bloomFilter) locations(key string, fn func(uint64) bool) bool {
+	h1 := fnv.New64a()
+	h1.Write([]byte(key))
+	a := h1.Sum64()
+
+	h2 := fnv.New64()
+	h2.Write([]byte(key))
+	b := h2.Sum64() | 1
+
+	for i := 0; i < f.k; i++ {
+		if !fn((a + uint64(i)*b) % f.m) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (f *bloomFilter) add(key string) {
+	f.locations(key, func(bit uint64) bool {
+		f.bits[bit/64] |= 1 << (bit % 64)
+		return true
+	})
+}
+
+func (f *bloomFilter) mayContain(key string) bool {
+	return f.locations(key, func(bit uint64) bool {
+		return f.bits[bit/64]&(1<<(bit%64)) != 0
+	})
+}
+
+type bloom struct {
+	cfg BloomConfig
+
+	mu sync.RWMutex
+	// current is nil until the first build has finished
+	current *bloomFilter
+	// pending is the filter being rebuilt; keys written meanwhile go to
+	// both filters
+	pending *bloomFilter
+
+	building sync.Mutex
+	stop     chan struct{}
+}
+
+// WithBloomFilter lets Has and Get answer for keys that are certainly not
+// in the table without running a query. The filter is built in the
+// background by streaming every key from the table and is only consulted
+// once that has finished. Keys written through this Datastore are added as
+// they are written; deleted keys keep matching until the next rebuild.
+// Keys written by other processes sharing the table never enter the
+// filter, so Has and Get report them missing until the next rebuild; only
+// use it when this Datastore is the table's only writer, or with a
+// RebuildInterval short enough for your readers. The filter is always
+// built from the primary, as a lagging replica would leave keys out.
+// The Datastore's Queries must implement KeysQueries.
+func WithBloomFilter(cfg BloomConfig) Option {
+	return func(d *Datastore) {
+		d.bloom = &bloom{cfg: cfg, stop: make(chan struct{})}
+	}
+}
+
+func (b *bloom) start(d *Datastore) {
+	go func() {
+		if err := d.RebuildBloomFilter(); err != nil {
+			log.Printf("sqlds: building bloom filter: %s", err)
+		}
+
+		if b.cfg.RebuildInterval <= 0 {
+			return
+		}
+
+		ticker := time.NewTicker(b.cfg.RebuildInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := d.RebuildBloomFilter(); err != nil {
+					log.Printf("sqlds: rebuilding bloom filter: %s", err)
+				}
+			case <-b.stop:
+				return
+			}
+		}
+	}()
+}
+
+// RebuildBloomFilter replaces the bloom filter with one built from the
+// keys currently in the table.
+func (d *Datastore) RebuildBloomFilter() error {
+	b := d.bloom
+	if b == nil {
+		return fmt.Errorf("sqlds: bloom filter is not enabled")
+	}
+
+	kq, ok := d.queries.(KeysQueries)
+	if !ok {
+		return fmt.Errorf("sqlds: %T cannot list keys", d.queries)
+	}
+
+	b.building.Lock()
+	defer b.building.Unlock()
+
+	f := newBloomFilter(b.cfg.ExpectedKeys, b.cfg.FalsePositiveRate)
+	b.mu.Lock()
+	b.pending = f
+	b.mu.Unlock()
+
+	err := d.scanKeys(kq, func(key string) {
+		b.mu.Lock()
+		f.add(key)
+		b.mu.Unlock()
+	})
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.pending = nil
+	if err != nil {
+		return err
+	}
+
+	b.current = f
+	return nil
+}
+
+func (d *Datastore) scanKeys(kq KeysQueries, fn func(key string)) error {
+	rows, err := d.db.Query(kq.Keys())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return err
+		}
+		fn(key)
+	}
+
+	return rows.Err()
+}
+
+func (b *bloom) add(keys ...ds.Key) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, key := range keys {
+		if b.current != nil {
+			b.current.add(key.String())
+		}
+		if b.pending != nil {
+			b.pending.add(key.String())
+		}
+	}
+}
+
+// missing reports whether key is certainly not in the table
+func (b *bloom) missing(key ds.Key) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return b.current != nil && !b.current.mayContain(key.String())
+}
+
+func (b *bloom) close() {
+	close(b.stop)
+}
@@ -0,0 +1,30 @@
+package sqlds
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBloomFilterFalsePositives(t *testing.T) {
+	f := newBloomFilter(10000, 0.01)
+	for i := 0; i < 10000; i++ {
+		f.add(fmt.Sprintf("/in/%d", i))
+	}
+
+	for i := 0; i < 10000; i++ {
+		if !f.mayContain(fmt.Sprintf("/in/%d", i)) {
+			t.Fatal("bloom filter lost a key")
+		}
+	}
+
+	fp := 0
+	for i := 0; i < 10000; i++ {
+		if f.mayContain(fmt.Sprintf("/out/%d", i)) {
+			fp++
+		}
+	}
+
+	if fp > 300 {
+		t.Fatalf("false positive rate too high: %d/10000", fp)
+	}
+}
@@ -0,0 +1,56 @@
+package sqlds_test
+
+import (
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	sqlds "github.com/whyrusleeping/sql-datastore"
+)
+
+func TestBloomFilterSkipsQueries(t *testing.T) {
+	d, done := newDS(t, sqlds.WithBloomFilter(sqlds.BloomConfig{
+		ExpectedKeys:      1000,
+		FalsePositiveRate: 0.001,
+	}))
+	defer done()
+
+	addTestCases(t, d, testcases)
+	if err := d.RebuildBloomFilter(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := d.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put(ds.NewKey("/batched"), []byte("batched")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// with the table gone, only answers from the filter can succeed
+	if _, err := d.DB().Exec("DROP TABLE blocks"); err != nil {
+		t.Fatal(err)
+	}
+
+	has, err := d.Has(ds.NewKey("/not/there"))
+	if err != nil {
+		t.Fatal("expected Has to be answered by the bloom filter: ", err)
+	}
+	if has {
+		t.Fatal("has returned true for key we don't have")
+	}
+
+	if _, err := d.Get(ds.NewKey("/not/there")); err != ds.ErrNotFound {
+		t.Fatal("expected ErrNotFound from the bloom filter, got: ", err)
+	}
+
+	// keys in the filter, rebuilt or batched, still go to the table
+	for _, k := range []string{"/a/b", "/batched"} {
+		if _, err := d.Has(ds.NewKey(k)); err == nil {
+			t.Fatalf("expected Has of %s to query the table", k)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package sqlds
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BreakerState is the state of a circuit breaker
+type BreakerState int
+
+const (
+	// BreakerClosed lets every call through
+	BreakerClosed BreakerState = iota
+	// BreakerOpen fails every call without touching the database
+	BreakerOpen
+	// BreakerHalfOpen is probing the database after the cooldown expired
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("BreakerState(%d)", int(s))
+	}
+}
+
+// BreakerConfig configures the circuit breaker
+type BreakerConfig struct {
+	// Threshold is the number of consecutive connection failures that
+	// trips the breaker. DefaultBreakerConfig.Threshold is used when it
+	// is not positive.
+	Threshold int
+	// Cooldown is how long the breaker stays open before probing
+	Cooldown time.Duration
+	// ProbeTimeout bounds the Ping sent while half-open
+	ProbeTimeout time.Duration
+	// IsFailure reports whether an error means the database is
+	// unreachable. IsConnectionError is used when it is nil.
+	IsFailure func(error) bool
+}
+
+// DefaultBreakerConfig trips after five consecutive connection failures
+// and probes again every ten seconds.
+var DefaultBreakerConfig = BreakerConfig{
+	Threshold:    5,
+	Cooldown:     10 * time.Second,
+	ProbeTimeout: 2 * time.Second,
+}
+
+// UnavailableError is returned without contacting the database while the
+// circuit breaker is open.
+type UnavailableError struct {
+	// Since is when the breaker last opened
+	Since time.Time
+	// Cause is the failure that opened it
+	Cause error
+}
+
+func (e *UnavailableError) Error() string {
+	return fmt.Sprintf("sqlds: database unavailable since %s: %s", e.Since.Format(time.RFC3339), e.Cause)
+}
+
+// ConnectionSQLState reports whether a SQLSTATE code means the database
+// could not be reached or went away: connection exceptions and server
+// shutdowns.
+func ConnectionSQLState(code string) bool {
+	if strings.HasPrefix(code, "08") {
+		return true
+	}
+
+	switch code {
+	case "57P01", // admin_shutdown
+		"57P02", // crash_shutdown
+		"57P03": // cannot_connect_now
+		return true
+	}
+
+	return false
+}
+
+// IsConnectionError is the default breaker classifier. It only counts
+// failures to reach the database, not errors in individual statements,
+// and recognises drivers whose errors expose their SQLSTATE through a
+// SQLState() method.
+func IsConnectionError(err error) bool {
+	switch err {
+	case driver.ErrBadConn, io.EOF, io.ErrUnexpectedEOF:
+		return true
+	}
+
+	if e, ok := err.(interface{ SQLState() string }); ok {
+		return ConnectionSQLState(e.SQLState())
+	}
+
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// Breaker is a circuit breaker guarding a Datastore's primary connection
+type Breaker struct {
+	mu       sync.Mutex
+	cfg      BreakerConfig
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	cause    error
+
+	ping func(ctx context.Context) error
+	now  func() time.Time
+}
+
+// WithCircuitBreaker makes every operation fail fast with an
+// *UnavailableError once cfg.Threshold consecutive connection failures
+// have been seen on the primary, until a Ping sent to it after
+// cfg.Cooldown succeeds. Failures of reads served by replicas are not
+// counted.
+func WithCircuitBreaker(cfg BreakerConfig) Option {
+	if cfg.Threshold <= 0 {
+		cfg.Threshold = DefaultBreakerConfig.Threshold
+	}
+
+	return func(d *Datastore) {
+		d.breaker = &Breaker{
+			cfg:  cfg,
+			ping: d.db.PingContext,
+			now:  time.Now,
+		}
+	}
+}
+
+// Breaker returns the datastore's circuit breaker, or nil if none was
+// configured.
+func (d *Datastore) Breaker() *Breaker {
+	return d.breaker
+}
+
+// State returns the breaker's current state
+func (b *Breaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Failures returns the number of consecutive connection failures seen
+func (b *Breaker) Failures() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failures
+}
+
+func (b *Breaker) unavailable() error {
+	return &UnavailableError{Since: b.openedAt, Cause: b.cause}
+}
+
+// allow reports whether a call may proceed, probing the database if the
+// cooldown has expired. Only one caller probes; the rest fail fast.
+func (b *Breaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerClosed:
+		return nil
+	case BreakerHalfOpen:
+		return b.unavailable()
+	}
+
+	if b.now().Sub(b.openedAt) < b.cfg.Cooldown {
+		return b.unavailable()
+	}
+
+	b.state = BreakerHalfOpen
+	b.mu.Unlock()
+	err := b.probe()
+	b.mu.Lock()
+
+	if err != nil {
+		b.trip(err)
+		return b.unavailable()
+	}
+
+	b.state = BreakerClosed
+	b.failures = 0
+	b.cause = nil
+	return nil
+}
+
+func (b *Breaker) probe() error {
+	ctx := context.Background()
+	if b.cfg.ProbeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.cfg.ProbeTimeout)
+		defer cancel()
+	}
+
+	return b.ping(ctx)
+}
+
+// trip opens the breaker; b.mu must be held
+func (b *Breaker) trip(cause error) {
+	b.state = BreakerOpen
+	b.openedAt = b.now()
+	b.cause = cause
+}
+
+func (b *Breaker) record(err error) {
+	isFailure := b.cfg.IsFailure
+	if isFailure == nil {
+		isFailure = IsConnectionError
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil || !isFailure(err) {
+		if b.state == BreakerClosed {
+			b.failures = 0
+		}
+		return
+	}
+
+	b.failures++
+	if b.state == BreakerClosed && b.failures >= b.cfg.Threshold {
+		b.trip(err)
+	}
+}
+
+// guard runs fn through the circuit breaker, if there is one, unless the
+// datastore's options cannot be combined
+func (d *Datastore) guard(fn func() error) error {
+	if d.invalid != nil {
+		return d.invalid
+	}
+
+	b := d.breaker
+	if b == nil {
+		return fn()
+	}
+
+	if err := b.allow(); err != nil {
+		return err
+	}
+
+	err := fn()
+	b.record(err)
+	return err
+}
+
+// guardRead is guard for reads, running fn against the database that
+// should serve the next read. Only failures on the primary are recorded,
+// since the breaker probes the primary alone and a replica that is down
+// says nothing about it.
+func (d *Datastore) guardRead(fn func(db *sql.DB) error) error {
+	if d.invalid != nil {
+		return d.invalid
+	}
+
+	db := d.reader()
+	b := d.breaker
+	if b == nil {
+		return fn(db)
+	}
+
+	if err := b.allow(); err != nil {
+		return err
+	}
+
+	err := fn(db)
+	if db == d.db {
+		b.record(err)
+	}
+	return err
+}
@@ -0,0 +1,123 @@
+package sqlds
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	db, err := sql.Open("postgres", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	d := NewDatastore(db, nil, WithCircuitBreaker(BreakerConfig{
+		Threshold: 3,
+		Cooldown:  time.Minute,
+	}))
+
+	now := time.Now()
+	pingErr := driver.ErrBadConn
+	b := d.Breaker()
+	b.now = func() time.Time { return now }
+	b.ping = func(context.Context) error { return pingErr }
+
+	down := func() error { return driver.ErrBadConn }
+	calls := 0
+	up := func() error {
+		calls++
+		return nil
+	}
+
+	// statement errors don't count as connection failures
+	d.guard(func() error { return errors.New("syntax error") })
+	for i := 0; i < 3; i++ {
+		if b.State() != BreakerClosed {
+			t.Fatalf("breaker opened after %d failures", i)
+		}
+		d.guard(down)
+	}
+
+	if b.State() != BreakerOpen {
+		t.Fatal("breaker should open after 3 consecutive failures, state: ", b.State())
+	}
+
+	err = d.guard(up)
+	if _, ok := err.(*UnavailableError); !ok {
+		t.Fatal("expected UnavailableError, got: ", err)
+	}
+	if calls != 0 {
+		t.Fatal("open breaker must not call through")
+	}
+
+	// a failed probe keeps the breaker open for another cooldown
+	now = now.Add(2 * time.Minute)
+	if _, ok := d.guard(up).(*UnavailableError); !ok {
+		t.Fatal("expected UnavailableError after failed probe")
+	}
+	if b.State() != BreakerOpen {
+		t.Fatal("breaker should reopen after a failed probe, state: ", b.State())
+	}
+
+	now = now.Add(2 * time.Minute)
+	pingErr = nil
+	if err := d.guard(up); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 || b.State() != BreakerClosed || b.Failures() != 0 {
+		t.Fatal("breaker should close after a successful probe, state: ", b.State())
+	}
+}
+
+func TestCircuitBreakerDefaultThreshold(t *testing.T) {
+	d := NewDatastore(nil, nil, WithCircuitBreaker(BreakerConfig{}))
+
+	for i := 0; i < DefaultBreakerConfig.Threshold; i++ {
+		if d.Breaker().State() != BreakerClosed {
+			t.Fatalf("breaker opened after %d failures", i)
+		}
+		d.guard(func() error { return driver.ErrBadConn })
+	}
+
+	if d.Breaker().State() != BreakerOpen {
+		t.Fatal("breaker should open after the default threshold, state: ", d.Breaker().State())
+	}
+}
+
+func TestCircuitBreakerIgnoresReplicas(t *testing.T) {
+	primary, _ := sql.Open("postgres", "")
+	replica, _ := sql.Open("postgres", "")
+	defer primary.Close()
+	defer replica.Close()
+
+	d := NewDatastoreWithReplicas(primary, []*sql.DB{replica}, nil, WithCircuitBreaker(BreakerConfig{
+		Threshold: 1,
+		Cooldown:  time.Minute,
+	}))
+
+	for i := 0; i < 3; i++ {
+		err := d.guardRead(func(db *sql.DB) error {
+			if db != replica {
+				t.Fatal("expected the read to go to the replica")
+			}
+			return driver.ErrBadConn
+		})
+		if err != driver.ErrBadConn {
+			t.Fatal("expected the replica's error, got: ", err)
+		}
+	}
+
+	if d.Breaker().State() != BreakerClosed || d.Breaker().Failures() != 0 {
+		t.Fatal("replica failures were counted against the primary, state: ", d.Breaker().State())
+	}
+
+	d.guard(func() error { return driver.ErrBadConn })
+	if d.Breaker().State() != BreakerOpen {
+		t.Fatal("a primary failure should open the breaker, state: ", d.Breaker().State())
+	}
+}
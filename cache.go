@@ -0,0 +1,176 @@
+package sqlds
+
+import (
+	"container/list"
+	"sync"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// entryOverhead approximates the bookkeeping cost of a cache entry
+const entryOverhead = 64
+
+// CacheStats are counters for the read cache
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	// Bytes is the approximate memory held by cached entries
+	Bytes int64
+	// Entries is the number of cached keys
+	Entries int
+}
+
+type cacheEntry struct {
+	key   string
+	value []byte
+	// size is -1 for entries that only record existence
+	size int
+	// hasValue is false for entries that only record existence and size
+	hasValue bool
+}
+
+func (e *cacheEntry) cost() int64 {
+	return int64(len(e.key) + len(e.value) + entryOverhead)
+}
+
+// cache is a size-bounded LRU of values, sizes and existence of keys that
+// are known to be present. Misses are not cached.
+type cache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	ll       *list.List
+	items    map[string]*list.Element
+	stats    CacheStats
+}
+
+// WithCache keeps recently read values, sizes and existence checks in an
+// LRU cache holding roughly maxBytes. Writes through this Datastore
+// invalidate it, but writes by other processes sharing the table do not.
+func WithCache(maxBytes int64) Option {
+	return func(d *Datastore) {
+		d.cache = &cache{
+			maxBytes: maxBytes,
+			ll:       list.New(),
+			items:    make(map[string]*list.Element),
+		}
+	}
+}
+
+// CacheStats returns a snapshot of the read cache counters
+func (d *Datastore) CacheStats() CacheStats {
+	if d.cache == nil {
+		return CacheStats{}
+	}
+
+	c := d.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Entries = c.ll.Len()
+	return stats
+}
+
+// lookup returns the entry for key if it satisfies want, counting a hit
+// or a miss
+func (c *cache) lookup(key ds.Key, want func(*cacheEntry) bool) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key.String()]
+	if !ok || !want(el.Value.(*cacheEntry)) {
+		c.stats.Misses++
+		return nil, false
+	}
+
+	c.ll.MoveToFront(el)
+	c.stats.Hits++
+	return el.Value.(*cacheEntry), true
+}
+
+func (c *cache) getValue(key ds.Key) ([]byte, bool) {
+	e, ok := c.lookup(key, func(e *cacheEntry) bool { return e.hasValue })
+	if !ok {
+		return nil, false
+	}
+
+	// callers may modify what Get returns, so never hand out our copy
+	out := make([]byte, len(e.value))
+	copy(out, e.value)
+	return out, true
+}
+
+func (c *cache) getSize(key ds.Key) (int, bool) {
+	e, ok := c.lookup(key, func(e *cacheEntry) bool { return e.size >= 0 })
+	if !ok {
+		return -1, false
+	}
+
+	return e.size, true
+}
+
+func (c *cache) has(key ds.Key) bool {
+	_, ok := c.lookup(key, func(*cacheEntry) bool { return true })
+	return ok
+}
+
+func (c *cache) add(e *cacheEntry) {
+	if e.cost() > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[e.key]; ok {
+		old := el.Value.(*cacheEntry)
+		if old.hasValue && !e.hasValue || old.size >= 0 && e.size < 0 {
+			// don't replace an entry with one that knows less
+			c.ll.MoveToFront(el)
+			return
+		}
+
+		c.stats.Bytes -= old.cost()
+		el.Value = e
+		c.ll.MoveToFront(el)
+	} else {
+		c.items[e.key] = c.ll.PushFront(e)
+	}
+
+	c.stats.Bytes += e.cost()
+	for c.stats.Bytes > c.maxBytes {
+		c.removeElement(c.ll.Back())
+		c.stats.Evictions++
+	}
+}
+
+func (c *cache) addValue(key ds.Key, value []byte) {
+	c.add(&cacheEntry{key: key.String(), value: value, size: len(value), hasValue: true})
+}
+
+func (c *cache) addSize(key ds.Key, size int) {
+	c.add(&cacheEntry{key: key.String(), size: size})
+}
+
+func (c *cache) addExists(key ds.Key) {
+	c.add(&cacheEntry{key: key.String(), size: -1})
+}
+
+func (c *cache) invalidate(keys ...ds.Key) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, key := range keys {
+		if el, ok := c.items[key.String()]; ok {
+			c.removeElement(el)
+		}
+	}
+}
+
+// removeElement drops el from the cache; c.mu must be held
+func (c *cache) removeElement(el *list.Element) {
+	e := c.ll.Remove(el).(*cacheEntry)
+	delete(c.items, e.key)
+	c.stats.Bytes -= e.cost()
+}
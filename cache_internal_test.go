@@ -0,0 +1,45 @@
+package sqlds
+
+import (
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+func TestCacheEviction(t *testing.T) {
+	d := NewDatastore(nil, nil, WithCache(3*(entryOverhead+10)))
+	c := d.cache
+
+	for _, k := range []string{"/a", "/b", "/c"} {
+		c.addValue(ds.NewKey(k), make([]byte, 8))
+	}
+
+	// touch /a so /b becomes the least recently used
+	if _, ok := c.getValue(ds.NewKey("/a")); !ok {
+		t.Fatal("expected /a to be cached")
+	}
+
+	c.addValue(ds.NewKey("/d"), make([]byte, 8))
+	if c.has(ds.NewKey("/b")) {
+		t.Fatal("expected /b to be evicted")
+	}
+	for _, k := range []string{"/a", "/c", "/d"} {
+		if !c.has(ds.NewKey(k)) {
+			t.Fatalf("expected %s to be cached", k)
+		}
+	}
+
+	// values larger than the cache are never stored
+	c.addValue(ds.NewKey("/big"), make([]byte, 1000))
+	if c.has(ds.NewKey("/big")) {
+		t.Fatal("oversized value was cached")
+	}
+
+	stats := d.CacheStats()
+	if stats.Evictions != 1 || stats.Entries != 3 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	if stats.Hits != 4 || stats.Misses != 2 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
@@ -0,0 +1,63 @@
+package sqlds_test
+
+import (
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	sqlds "github.com/whyrusleeping/sql-datastore"
+)
+
+func TestCacheInvalidation(t *testing.T) {
+	d, done := newDS(t, sqlds.WithCache(1<<20))
+	defer done()
+
+	addTestCases(t, d, testcases)
+
+	k := ds.NewKey("/a/b")
+	if _, err := d.Get(k); err != nil {
+		t.Fatal(err)
+	}
+	before := d.CacheStats()
+	if _, err := d.Get(k); err != nil {
+		t.Fatal(err)
+	}
+	size, err := d.GetSize(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != len("ab") {
+		t.Fatalf("incorrect size: expected %d, got %d", len("ab"), size)
+	}
+	if after := d.CacheStats(); after.Hits != before.Hits+2 {
+		t.Fatalf("expected cache hits, got %+v", after)
+	}
+
+	if err := d.Delete(k); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Get(k); err != ds.ErrNotFound {
+		t.Fatal("expected ErrNotFound after delete, got: ", err)
+	}
+
+	k = ds.NewKey("/a/c")
+	if has, err := d.Has(k); err != nil || !has {
+		t.Fatal("expected /a/c to exist: ", err)
+	}
+
+	b, err := d.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Delete(k); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := d.Has(k); !has {
+		t.Fatal("uncommitted batch delete should not be visible")
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := d.Has(k); has {
+		t.Fatal("committed batch delete should invalidate the cache")
+	}
+}
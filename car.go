@@ -0,0 +1,227 @@
+package sqlds
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+
+	car "github.com/ipfs/go-car"
+	carutil "github.com/ipfs/go-car/util"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// CarProgress reports how far an Export or Import has got
+type CarProgress struct {
+	// Blocks is the number of blocks written so far
+	Blocks int64
+	// Bytes is the total size of their data
+	Bytes int64
+	// Skipped counts keys that could not be turned into a CID
+	Skipped int64
+}
+
+type carOptions struct {
+	roots     []cid.Cid
+	progress  func(CarProgress)
+	batchSize int
+}
+
+// CarOption configures Export and Import
+type CarOption func(*carOptions)
+
+// CarRoots sets the roots recorded in an exported CAR header. CARs without
+// roots can be imported again, but some tools refuse to read them.
+func CarRoots(roots ...cid.Cid) CarOption {
+	return func(o *carOptions) {
+		o.roots = roots
+	}
+}
+
+// CarProgressFunc registers a callback that is invoked after every block
+func CarProgressFunc(fn func(CarProgress)) CarOption {
+	return func(o *carOptions) {
+		o.progress = fn
+	}
+}
+
+// CarBatchSize sets how many blocks Import commits per batch
+func CarBatchSize(n int) CarOption {
+	return func(o *carOptions) {
+		o.batchSize = n
+	}
+}
+
+func newCarOptions(opts []CarOption) *carOptions {
+	o := &carOptions{batchSize: 1000}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
+}
+
+func (o *carOptions) report(p CarProgress) {
+	if o.progress != nil {
+		o.progress(p)
+	}
+}
+
+// KeyCid decodes the CID of a block key. Keys written by older go-ipfs
+// versions hold the whole CID; newer ones hold only the multihash. A bare
+// sha2-256 multihash cannot be told apart from a CIDv0 and is returned as
+// one, other multihashes become raw CIDv1s.
+func KeyCid(key ds.Key) (cid.Cid, error) {
+	buf, err := keyEncoding.DecodeString(key.BaseNamespace())
+	if err != nil {
+		return cid.Cid{}, err
+	}
+
+	if c, err := cid.Cast(buf); err == nil {
+		return c, nil
+	}
+
+	hash, err := mh.Cast(buf)
+	if err != nil {
+		return cid.Cid{}, err
+	}
+
+	return cid.NewCidV1(cid.Raw, hash), nil
+}
+
+// CidKey returns the key a block is stored under
+func CidKey(c cid.Cid) ds.Key {
+	return BlocksPrefix.ChildString(keyEncoding.EncodeToString(c.Hash()))
+}
+
+// Export streams every block below prefix (BlocksPrefix if empty) to w as
+// a CARv1 file. Keys that do not decode to a CID are skipped.
+func (d *Datastore) Export(ctx context.Context, prefix string, w io.Writer, opts ...CarOption) error {
+	o := newCarOptions(opts)
+	if prefix == "" {
+		prefix = BlocksPrefix.String()
+	}
+
+	roots := o.roots
+	if roots == nil {
+		roots = []cid.Cid{}
+	}
+
+	header, err := cbor.DumpObject(&car.CarHeader{Roots: roots, Version: 1})
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	if err := carutil.LdWrite(bw, header); err != nil {
+		return err
+	}
+
+	var p CarProgress
+	err = d.scan(ctx, d.reader(), prefix, func(key string, value []byte) error {
+		c, err := KeyCid(ds.RawKey(key))
+		if err != nil {
+			p.Skipped++
+			o.report(p)
+			return nil
+		}
+
+		if err := carutil.LdWrite(bw, c.Bytes(), value); err != nil {
+			return err
+		}
+
+		p.Blocks++
+		p.Bytes += int64(len(value))
+		o.report(p)
+		return ctx.Err()
+	})
+	if err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+// Import reads a CARv1 file from r and stores its blocks through batches,
+// checking every block against its CID.
+func (d *Datastore) Import(ctx context.Context, r io.Reader, opts ...CarOption) (err error) {
+	o := newCarOptions(opts)
+	br := bufio.NewReader(r)
+
+	header, err := car.ReadHeader(br)
+	if err != nil {
+		return err
+	}
+
+	if header.Version != 1 {
+		return fmt.Errorf("sqlds: unsupported car version %d", header.Version)
+	}
+
+	var p CarProgress
+	var b *batch
+	pending := 0
+	defer func() {
+		// blocks of a batch that was not committed are dropped
+		if err != nil && b != nil && b.txn != nil {
+			b.txn.Rollback()
+		}
+	}()
+
+	commit := func() error {
+		if pending == 0 {
+			return nil
+		}
+
+		err := b.Commit()
+		if err == nil {
+			b, pending = nil, 0
+		}
+		return err
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		c, data, err := carutil.ReadNode(br)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		hashed, err := c.Prefix().Sum(data)
+		if err != nil {
+			return err
+		}
+		if !hashed.Equals(c) {
+			return fmt.Errorf("sqlds: car block %s does not match its data", c)
+		}
+
+		if b == nil {
+			b = &batch{ds: d}
+		}
+
+		if err := b.Put(CidKey(c), data); err != nil {
+			return err
+		}
+
+		pending++
+		p.Blocks++
+		p.Bytes += int64(len(data))
+		o.report(p)
+
+		if pending >= o.batchSize {
+			if err := commit(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return commit()
+}
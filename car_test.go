@@ -0,0 +1,111 @@
+package sqlds_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base32"
+	"fmt"
+	"testing"
+
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	mh "github.com/multiformats/go-multihash"
+	sqlds "github.com/whyrusleeping/sql-datastore"
+)
+
+func TestKeyCid(t *testing.T) {
+	hash, err := mh.Sum([]byte("block"), mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := cid.NewCidV1(cid.Raw, hash)
+	got, err := sqlds.KeyCid(sqlds.CidKey(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equals(cid.NewCidV0(hash)) {
+		t.Fatalf("expected a CIDv0 for a sha2-256 key, got %s", got)
+	}
+
+	hash, err = mh.Sum([]byte("block"), mh.SHA2_512, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = cid.NewCidV1(cid.Raw, hash)
+	got, err = sqlds.KeyCid(sqlds.CidKey(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equals(c) {
+		t.Fatalf("expected %s, got %s", c, got)
+	}
+
+	// keys written before CidKey hold the whole CID
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding)
+	legacy := sqlds.BlocksPrefix.ChildString(enc.EncodeToString(c.Bytes()))
+	got, err = sqlds.KeyCid(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equals(c) {
+		t.Fatalf("expected %s from cid key, got %s", c, got)
+	}
+
+	if _, err := sqlds.KeyCid(ds.NewKey("/blocks/not-base32")); err == nil {
+		t.Fatal("expected an error for a non-block key")
+	}
+}
+
+func TestCarRoundTrip(t *testing.T) {
+	src, done := newDS(t)
+	defer done()
+
+	var keys []ds.Key
+	for i := 0; i < 25; i++ {
+		data := []byte(fmt.Sprintf("block %d", i))
+		k := blockKey(t, data)
+		if err := src.Put(k, data); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, k)
+	}
+	if err := src.Put(sqlds.BlocksPrefix.ChildString("garbage!"), []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Put(ds.NewKey("/pins/a"), []byte("not a block")); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	var last sqlds.CarProgress
+	err := src.Export(context.Background(), "", &buf, sqlds.CarProgressFunc(func(p sqlds.CarProgress) {
+		last = p
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.Blocks != 25 || last.Skipped != 1 {
+		t.Fatalf("unexpected export progress: %+v", last)
+	}
+
+	for _, k := range keys {
+		if err := src.Delete(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := src.Import(context.Background(), &buf, sqlds.CarBatchSize(10)); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, k := range keys {
+		val, err := src.Get(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(val) != fmt.Sprintf("block %d", i) {
+			t.Fatalf("wrong value for %s: %s", k, val)
+		}
+	}
+}
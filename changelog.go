@@ -0,0 +1,342 @@
+package sqlds
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// ChangeLogQueries are the statements needed to keep an append-only log of
+// writes next to the blocks table.
+type ChangeLogQueries interface {
+	// LogChange appends op ($1) of key ($2), assigning the next sequence
+	// number and the time the statement runs, not the time its
+	// transaction started
+	LogChange() string
+	// ChangesSince selects seq, op, key, time and whether the change was
+	// logged at least $3 seconds ago by the database clock, of up to $2
+	// changes with a sequence number above $1, in sequence order. Changes
+	// of other namespaces are included so that the sequence numbers they
+	// take are not mistaken for uncommitted writes, but with a NULL op,
+	// key and time.
+	ChangesSince() string
+	// OldestChange selects the lowest retained sequence number, or NULL
+	OldestChange() string
+	// NewestChange selects the highest sequence number, or NULL
+	NewestChange() string
+	// CompactChanges deletes changes logged before $1, always keeping the
+	// newest one so that expired cursors can be detected
+	CompactChanges() string
+}
+
+// ChangeOp is the kind of write recorded in the change log
+type ChangeOp string
+
+const (
+	// ChangePut records a key being inserted
+	ChangePut ChangeOp = "put"
+	// ChangeDelete records a key being deleted
+	ChangeDelete ChangeOp = "delete"
+)
+
+// Change is an entry of the change log
+type Change struct {
+	Seq  int64
+	Op   ChangeOp
+	Key  ds.Key
+	Time time.Time
+}
+
+// ErrCursorExpired is returned by Changes when changes after the cursor
+// have already been compacted away. The consumer has to resynchronise,
+// e.g. with a full Query, and continue from ChangeLogHead.
+var ErrCursorExpired = errors.New("sqlds: change log cursor expired")
+
+// ChangeLogConfig configures the change log
+type ChangeLogConfig struct {
+	// Retention is how long changes are kept. Zero keeps them forever.
+	Retention time.Duration
+	// CompactInterval is how often changes older than Retention are
+	// removed in the background
+	CompactInterval time.Duration
+	// SettleTime is how long Changes waits for a missing sequence number
+	// to be committed before skipping it. Sequence numbers are handed out
+	// just before commit, so a writer that is committing leaves a
+	// temporary hole; one that rolled back leaves a permanent one. Changes
+	// are logged as the last statements of their transaction, however long
+	// it ran, and both stamped and aged by the database clock, so
+	// SettleTime only has to cover how long a commit takes.
+	SettleTime time.Duration
+	// PageSize is the number of changes fetched per query
+	PageSize int
+}
+
+// DefaultChangeLogConfig keeps a week of changes
+var DefaultChangeLogConfig = ChangeLogConfig{
+	Retention:       7 * 24 * time.Hour,
+	CompactInterval: time.Hour,
+	SettleTime:      5 * time.Second,
+	PageSize:        1000,
+}
+
+type changelog struct {
+	cfg  ChangeLogConfig
+	stop chan struct{}
+}
+
+// WithChangeLog records every Put and Delete that changes the table, and
+// every write in a committed batch, in a change log written in the same
+// transaction. The Datastore's Queries must implement ChangeLogQueries.
+func WithChangeLog(cfg ChangeLogConfig) Option {
+	return func(d *Datastore) {
+		d.changelog = &changelog{cfg: cfg, stop: make(chan struct{})}
+	}
+}
+
+func (c *changelog) start(d *Datastore) {
+	if c.cfg.Retention <= 0 || c.cfg.CompactInterval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(c.cfg.CompactInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				_, err := d.CompactChangeLog(time.Now().Add(-c.cfg.Retention))
+				if err != nil {
+					log.Printf("sqlds: compacting change log: %s", err)
+				}
+			case <-c.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (c *changelog) close() {
+	close(c.stop)
+}
+
+func (d *Datastore) changeLogQueries() (ChangeLogQueries, error) {
+	cq, ok := d.queries.(ChangeLogQueries)
+	if !ok {
+		return nil, fmt.Errorf("sqlds: %T does not support a change log", d.queries)
+	}
+
+	return cq, nil
+}
+
+// deferredLog is a transaction whose change log entries are held back
+// until flushChanges, right before it commits. Taking sequence numbers at
+// the end keeps a long transaction from holding a hole open in the log
+// while later changes are consumed past it.
+type deferredLog struct {
+	*sql.Tx
+	changes []Change
+}
+
+// logChange records op if result shows the write changed a row
+func (d *Datastore) logChange(e execer, op ChangeOp, key ds.Key, result sql.Result) error {
+	if d.changelog == nil {
+		return nil
+	}
+
+	cq, err := d.changeLogQueries()
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil || rows == 0 {
+		return err
+	}
+
+	if dl, ok := e.(*deferredLog); ok {
+		dl.changes = append(dl.changes, Change{Op: op, Key: key})
+		return nil
+	}
+
+	_, err = e.Exec(cq.LogChange(), string(op), key.String())
+	return err
+}
+
+// flushChanges writes the change log entries held back in dl
+func (d *Datastore) flushChanges(dl *deferredLog) error {
+	if len(dl.changes) == 0 {
+		return nil
+	}
+
+	cq, err := d.changeLogQueries()
+	if err != nil {
+		return err
+	}
+
+	for _, c := range dl.changes {
+		if _, err := dl.Exec(cq.LogChange(), string(c.Op), c.Key.String()); err != nil {
+			return err
+		}
+	}
+
+	dl.changes = nil
+	return nil
+}
+
+// CompactChangeLog removes changes logged before olderThan and returns how
+// many were removed.
+func (d *Datastore) CompactChangeLog(olderThan time.Time) (int64, error) {
+	cq, err := d.changeLogQueries()
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := d.db.Exec(cq.CompactChanges(), olderThan)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// ChangeLogHead returns the sequence number of the newest change, or 0 if
+// nothing has been logged. A new consumer can take a snapshot and then
+// follow Changes from the head it read beforehand.
+func (d *Datastore) ChangeLogHead() (int64, error) {
+	cq, err := d.changeLogQueries()
+	if err != nil {
+		return 0, err
+	}
+
+	var head sql.NullInt64
+	if err := d.db.QueryRow(cq.NewestChange()).Scan(&head); err != nil {
+		return 0, err
+	}
+
+	return head.Int64, nil
+}
+
+// ChangeIterator walks the change log in sequence order
+type ChangeIterator struct {
+	ctx    context.Context
+	d      *Datastore
+	cq     ChangeLogQueries
+	cursor int64
+	// read is the sequence number the next fetch continues after; it runs
+	// ahead of cursor over the changes of other namespaces
+	read int64
+	buf  []Change
+	done bool
+	err  error
+}
+
+// Changes returns an iterator over changes with a sequence number above
+// sinceSeq. It ends once it has caught up with the log; persist Cursor and
+// call Changes again to resume.
+func (d *Datastore) Changes(ctx context.Context, sinceSeq int64) (*ChangeIterator, error) {
+	if d.changelog == nil {
+		return nil, errors.New("sqlds: change log is not enabled")
+	}
+
+	cq, err := d.changeLogQueries()
+	if err != nil {
+		return nil, err
+	}
+
+	var oldest sql.NullInt64
+	if err := d.db.QueryRowContext(ctx, cq.OldestChange()).Scan(&oldest); err != nil {
+		return nil, err
+	}
+
+	if oldest.Valid && sinceSeq < oldest.Int64-1 {
+		return nil, ErrCursorExpired
+	}
+
+	return &ChangeIterator{ctx: ctx, d: d, cq: cq, cursor: sinceSeq, read: sinceSeq}, nil
+}
+
+// Next returns the next change, or false once the iterator has caught up
+// or failed; check Err to tell the two apart.
+func (it *ChangeIterator) Next() (Change, bool) {
+	for len(it.buf) == 0 && !it.done {
+		it.fetch()
+	}
+
+	if len(it.buf) == 0 {
+		return Change{}, false
+	}
+
+	c := it.buf[0]
+	it.buf = it.buf[1:]
+	it.cursor = c.Seq
+	return c, true
+}
+
+// Cursor is the sequence number of the last change returned by Next
+func (it *ChangeIterator) Cursor() int64 {
+	return it.cursor
+}
+
+// Err returns the error that stopped the iterator, if any
+func (it *ChangeIterator) Err() error {
+	return it.err
+}
+
+func (it *ChangeIterator) fetch() {
+	cfg := it.d.changelog.cfg
+	pageSize := cfg.PageSize
+	if pageSize <= 0 {
+		pageSize = DefaultChangeLogConfig.PageSize
+	}
+
+	settle := cfg.SettleTime.Seconds()
+	rows, err := it.d.db.QueryContext(it.ctx, it.cq.ChangesSince(), it.read, pageSize, settle)
+	if err != nil {
+		it.done, it.err = true, err
+		return
+	}
+	defer rows.Close()
+
+	n := 0
+	for rows.Next() {
+		var c Change
+		var op, key sql.NullString
+		var ts sql.NullTime
+		var settled bool
+		if err := rows.Scan(&c.Seq, &op, &key, &ts, &settled); err != nil {
+			it.done, it.err = true, err
+			return
+		}
+		n++
+
+		if c.Seq != it.read+1 && !settled {
+			// an earlier write may still commit; stop here for now
+			it.done = true
+			return
+		}
+		it.read = c.Seq
+
+		if !op.Valid {
+			// a change of another namespace
+			continue
+		}
+
+		c.Op, c.Key, c.Time = ChangeOp(op.String), ds.RawKey(key.String), ts.Time
+		it.buf = append(it.buf, c)
+	}
+
+	if err := rows.Err(); err != nil {
+		it.done, it.err = true, err
+		return
+	}
+
+	if n < pageSize {
+		it.done = true
+	}
+}
@@ -0,0 +1,147 @@
+package sqlds_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	sqlds "github.com/whyrusleeping/sql-datastore"
+	"github.com/whyrusleeping/sql-datastore/internal/testdb"
+)
+
+func collectChanges(t *testing.T, d *sqlds.Datastore, since int64) ([]sqlds.Change, int64) {
+	it, err := d.Changes(context.Background(), since)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out []sqlds.Change
+	for {
+		c, ok := it.Next()
+		if !ok {
+			break
+		}
+		out = append(out, c)
+	}
+
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return out, it.Cursor()
+}
+
+func TestChangeLog(t *testing.T) {
+	cfg := sqlds.DefaultChangeLogConfig
+	cfg.PageSize = 2
+	d, done := newDS(t, sqlds.WithChangeLog(cfg))
+	defer done()
+
+	if err := d.Put(ds.NewKey("/a"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	// writing an existing key changes nothing and is not logged
+	if err := d.Put(ds.NewKey("/a"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := d.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"/b", "/c"} {
+		if err := b.Put(ds.NewKey(k), []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	changes, cursor := collectChanges(t, d, 0)
+	if len(changes) != 1 {
+		t.Fatalf("uncommitted batch must not be visible, got %d changes", len(changes))
+	}
+
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete(ds.NewKey("/a")); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, cursor = collectChanges(t, d, cursor)
+	expect := []sqlds.Change{
+		{Op: sqlds.ChangePut, Key: ds.NewKey("/b")},
+		{Op: sqlds.ChangePut, Key: ds.NewKey("/c")},
+		{Op: sqlds.ChangeDelete, Key: ds.NewKey("/a")},
+	}
+	if len(changes) != len(expect) {
+		t.Fatalf("expected %d changes, got %d", len(expect), len(changes))
+	}
+	for i, c := range changes {
+		if c.Op != expect[i].Op || !c.Key.Equal(expect[i].Key) {
+			t.Fatalf("change %d: expected %s %s, got %s %s", i, expect[i].Op, expect[i].Key, c.Op, c.Key)
+		}
+	}
+
+	head, err := d.ChangeLogHead()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head != cursor {
+		t.Fatalf("cursor %d should have caught up with head %d", cursor, head)
+	}
+
+	n, err := d.CompactChangeLog(time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("expected all but the newest change to be compacted, removed %d", n)
+	}
+
+	if _, err := d.Changes(context.Background(), 0); err != sqlds.ErrCursorExpired {
+		t.Fatal("expected ErrCursorExpired for compacted cursor, got: ", err)
+	}
+
+	changes, _ = collectChanges(t, d, cursor)
+	if len(changes) != 0 {
+		t.Fatal("expected no changes after the head")
+	}
+}
+
+// TestChangeLogLongTransaction needs two writers at once, which SQLite
+// does not allow
+func TestChangeLogLongTransaction(t *testing.T) {
+	testdb.RequirePostgres(t)
+
+	cfg := sqlds.DefaultChangeLogConfig
+	// skip holes at once, so a change logged out of order is lost
+	cfg.SettleTime = 0
+	d, done := newDS(t, sqlds.WithChangeLog(cfg))
+	defer done()
+
+	b, err := d.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put(ds.NewKey("/slow"), []byte("slow")); err != nil {
+		t.Fatal(err)
+	}
+
+	// a write that starts later and commits first
+	if err := d.Put(ds.NewKey("/fast"), []byte("fast")); err != nil {
+		t.Fatal(err)
+	}
+	changes, cursor := collectChanges(t, d, 0)
+	if len(changes) != 1 || changes[0].Key != ds.NewKey("/fast") {
+		t.Fatalf("expected only /fast, got %v", changes)
+	}
+
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	changes, _ = collectChanges(t, d, cursor)
+	if len(changes) != 1 || changes[0].Key != ds.NewKey("/slow") {
+		t.Fatalf("the long transaction's change was lost: %v", changes)
+	}
+}
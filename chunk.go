@@ -0,0 +1,565 @@
+package sqlds
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// ChunkQueries are the statements needed to split large values into chunk
+// rows. A chunked value has no inline data; its blocks row records the
+// total size instead, which is NULL for values stored inline.
+type ChunkQueries interface {
+	// PutChunked inserts key ($1) with total size ($2) and no inline
+	// data, unless the key exists
+	PutChunked() string
+	// PutChunk inserts chunk number $2 of key ($1) with data ($3)
+	PutChunk() string
+	// GetChunked selects inline data and size of key ($1)
+	GetChunked() string
+	// GetSizeChunked selects the length of the value of key ($1), inline
+	// or chunked
+	GetSizeChunked() string
+	// QueryChunked selects key, inline data and size, and accepts the
+	// Prefix, Limit and Offset suffixes
+	QueryChunked() string
+	// GetChunks selects the data of every chunk of key ($1) in order
+	GetChunks() string
+	// DeleteChunks deletes the chunks of key ($1)
+	DeleteChunks() string
+	// SetChunkedSize sets the total size of key ($1) to $2 once all its
+	// chunks are written
+	SetChunkedSize() string
+}
+
+// ChunkConfig configures chunked storage
+type ChunkConfig struct {
+	// Threshold is the size above which values are split into chunks
+	Threshold int
+	// ChunkSize is the size of every chunk but the last
+	ChunkSize int
+}
+
+// DefaultChunkConfig splits values larger than 16MiB into 1MiB chunks
+var DefaultChunkConfig = ChunkConfig{
+	Threshold: 16 << 20,
+	ChunkSize: 1 << 20,
+}
+
+// ErrIncompleteValue is returned when the chunks of a value do not add up
+// to its recorded size
+var ErrIncompleteValue = errors.New("sqlds: chunked value is incomplete")
+
+// WithChunking stores values larger than cfg.Threshold as a sequence of
+// chunk rows, so that no single row approaches the database's value size
+// limit. Get reassembles them and GetReader streams them. Once values have
+// been stored chunked the datastore must keep using this option. It cannot
+// be combined with WithEncryption, WithDedup or WithVersioning, and the
+// Datastore's Queries must implement ChunkQueries.
+func WithChunking(cfg ChunkConfig) Option {
+	if cfg.Threshold <= 0 {
+		cfg.Threshold = DefaultChunkConfig.Threshold
+	}
+	if cfg.ChunkSize <= 0 {
+		cfg.ChunkSize = DefaultChunkConfig.ChunkSize
+	}
+
+	return func(d *Datastore) {
+		d.chunks = &cfg
+	}
+}
+
+func (d *Datastore) chunkQueries() (ChunkQueries, error) {
+	if d.invalid != nil {
+		return nil, d.invalid
+	}
+
+	cq, ok := d.queries.(ChunkQueries)
+	if !ok {
+		return nil, fmt.Errorf("sqlds: %T does not support chunking", d.queries)
+	}
+
+	return cq, nil
+}
+
+func (d *Datastore) putChunked(e execer, key ds.Key, value []byte) (sql.Result, error) {
+	cq, err := d.chunkQueries()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(value) <= d.chunks.Threshold {
+		return e.Exec(d.queries.Put(), key.String(), value)
+	}
+
+	result, err := e.Exec(cq.PutChunked(), key.String(), len(value))
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil || rows == 0 {
+		// the key exists and keeps its value
+		return result, err
+	}
+
+	for i := 0; len(value) > 0; i++ {
+		n := d.chunks.ChunkSize
+		if n > len(value) {
+			n = len(value)
+		}
+
+		if _, err := e.Exec(cq.PutChunk(), key.String(), i, value[:n]); err != nil {
+			return nil, err
+		}
+		value = value[n:]
+	}
+
+	return result, nil
+}
+
+func (d *Datastore) deleteChunked(e execer, key ds.Key) (sql.Result, error) {
+	cq, err := d.chunkQueries()
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := e.Exec(d.queries.Delete(), key.String())
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := e.Exec(cq.DeleteChunks(), key.String()); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// chunkTxOptions are those of the transaction a value is read in, so that
+// its size and its chunks come from the same write
+var chunkTxOptions = &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true}
+
+// openChunked returns a reader over the value of key and its size. The
+// reader holds the transaction the value is read in until it is closed.
+func (d *Datastore) openChunked(db *sql.DB, key ds.Key) (io.ReadCloser, int64, error) {
+	cq, err := d.chunkQueries()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	txn, err := db.BeginTx(context.Background(), chunkTxOptions)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var data []byte
+	var size sql.NullInt64
+	row := txn.QueryRow(cq.GetChunked(), key.String())
+
+	switch err := row.Scan(&data, &size); err {
+	case sql.ErrNoRows:
+		txn.Rollback()
+		return nil, 0, ds.ErrNotFound
+	case nil:
+	default:
+		txn.Rollback()
+		return nil, 0, err
+	}
+
+	if !size.Valid {
+		if err := txn.Commit(); err != nil {
+			return nil, 0, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(data)), int64(len(data)), nil
+	}
+
+	rows, err := txn.Query(cq.GetChunks(), key.String())
+	if err != nil {
+		txn.Rollback()
+		return nil, 0, err
+	}
+
+	return &chunkReader{txn: txn, rows: rows, size: size.Int64}, size.Int64, nil
+}
+
+func (d *Datastore) getChunked(db *sql.DB, key ds.Key) ([]byte, error) {
+	r, size, err := d.openChunked(db, key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	buf := bytes.NewBuffer(make([]byte, 0, size))
+	if _, err := buf.ReadFrom(r); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (d *Datastore) getSizeChunked(db *sql.DB, key ds.Key) (int, error) {
+	cq, err := d.chunkQueries()
+	if err != nil {
+		return 0, err
+	}
+
+	row := db.QueryRow(cq.GetSizeChunked(), key.String())
+	var size int
+
+	switch err := row.Scan(&size); err {
+	case sql.ErrNoRows:
+		return -1, ds.ErrNotFound
+	case nil:
+		return size, nil
+	default:
+		return 0, err
+	}
+}
+
+func (d *Datastore) rawQueryChunked(db *sql.DB, q dsq.Query) (dsq.Results, error) {
+	cq, err := d.chunkQueries()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(d.withParams(cq.QueryChunked(), q))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []dsq.Entry
+	var chunked []int
+	defer rows.Close()
+
+	for rows.Next() {
+		var key string
+		var data []byte
+		var size sql.NullInt64
+		if err := rows.Scan(&key, &data, &size); err != nil {
+			return nil, err
+		}
+
+		if size.Valid {
+			chunked = append(chunked, len(entries))
+		}
+
+		entries = append(entries, dsq.Entry{
+			Key:   key,
+			Value: data,
+		})
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	// chunks are fetched once the listing is done, so that only one
+	// connection is held at a time
+	for _, i := range chunked {
+		value, err := d.getChunked(db, ds.RawKey(entries[i].Key))
+		if err != nil {
+			return nil, err
+		}
+		entries[i].Value = value
+	}
+
+	return dsq.ResultsWithEntries(q, entries), nil
+}
+
+// scanChunked is scan for a chunked table. Reading a chunked value takes a
+// connection of its own, which a pool of one connection could only hand out
+// once the listing is closed, so the keys are listed first and their values
+// read one at a time afterwards.
+func (d *Datastore) scanChunked(ctx context.Context, db *sql.DB, prefix string, fn func(key string, value []byte) error) error {
+	cq, err := d.chunkQueries()
+	if err != nil {
+		return err
+	}
+
+	rows, err := db.QueryContext(ctx, d.withParams(cq.QueryChunked(), dsq.Query{Prefix: prefix}))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		var data []byte
+		var size sql.NullInt64
+		if err := rows.Scan(&key, &data, &size); err != nil {
+			return err
+		}
+		keys = append(keys, key)
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		value, err := d.getChunked(db, ds.RawKey(key))
+		if err == ds.ErrNotFound {
+			// deleted since it was listed
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// StreamingBatch is implemented by the batches of a Datastore, to add
+// values read from a stream to the batch's transaction
+type StreamingBatch interface {
+	ds.Batch
+	PutReader(ctx context.Context, key ds.Key, r io.Reader) error
+}
+
+var _ StreamingBatch = (*batch)(nil)
+
+// PutReader stores the value read from r under key. With chunking enabled,
+// values above the threshold are written a chunk at a time as they are
+// read, so at most the threshold is buffered; otherwise r is read whole
+// and stored as by Put. As with Put, an existing key keeps its value.
+func (d *Datastore) PutReader(ctx context.Context, key ds.Key, r io.Reader) error {
+	if d.cache != nil {
+		defer d.cache.invalidate(key)
+	}
+
+	if d.bloom != nil {
+		d.bloom.add(key)
+		defer d.bloom.add(key)
+	}
+
+	var ev AuditEvent
+	// not retried, r cannot be read again
+	err := d.guard(func() error {
+		return d.write(func(e execer) (err error) {
+			ev, err = d.putReaderAudited(ctx, e, key, r)
+			return err
+		})
+	})
+
+	if err == nil {
+		d.emitAudit(ev)
+	}
+
+	return err
+}
+
+func (b *batch) PutReader(ctx context.Context, key ds.Key, r io.Reader) error {
+	if _, err := b.GetTransaction(); err != nil {
+		return err
+	}
+
+	if b.ds.bloom != nil {
+		b.ds.bloom.add(key)
+	}
+
+	var ev AuditEvent
+	err := b.ds.guard(func() (err error) {
+		ev, err = b.ds.putReaderAudited(ctx, b.log, key, r)
+		return err
+	})
+	if err != nil {
+		b.txn.Rollback()
+		return err
+	}
+
+	b.touched = append(b.touched, key)
+	if b.ds.audit != nil {
+		b.events = append(b.events, ev)
+	}
+	return nil
+}
+
+// putReaderAudited runs putReader and records it in the audit log, if
+// there is one, with the number of bytes read as size
+func (d *Datastore) putReaderAudited(ctx context.Context, e execer, key ds.Key, r io.Reader) (AuditEvent, error) {
+	if d.audit == nil {
+		return AuditEvent{}, d.putReader(ctx, e, key, r)
+	}
+
+	cr := &countingReader{r: r}
+	if err := d.putReader(ctx, e, key, cr); err != nil {
+		return AuditEvent{}, err
+	}
+
+	ev := d.auditEvent(ctx, AuditPut, key, cr.n)
+	return ev, d.recordAudit(e, ev)
+}
+
+func (d *Datastore) putReader(ctx context.Context, e execer, key ds.Key, r io.Reader) error {
+	if d.chunks == nil {
+		value, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		return d.put(e, key, value)
+	}
+
+	cq, err := d.chunkQueries()
+	if err != nil {
+		return err
+	}
+
+	head := make([]byte, d.chunks.Threshold+1)
+	n, err := io.ReadFull(r, head)
+	switch err {
+	case io.EOF, io.ErrUnexpectedEOF:
+		// small enough to be stored inline
+		return d.put(e, key, head[:n])
+	case nil:
+	default:
+		return err
+	}
+
+	// the size is only known at the end, it is filled in then
+	result, err := e.Exec(cq.PutChunked(), key.String(), 0)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil || rows == 0 {
+		// the key exists and keeps its value
+		return err
+	}
+
+	src := io.MultiReader(bytes.NewReader(head), r)
+	buf := make([]byte, d.chunks.ChunkSize)
+	var size int64
+	for i := 0; ; i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		n, err := io.ReadFull(src, buf)
+		if n > 0 {
+			if _, err := e.Exec(cq.PutChunk(), key.String(), i, buf[:n]); err != nil {
+				return err
+			}
+			size += int64(n)
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := e.Exec(cq.SetChunkedSize(), key.String(), size); err != nil {
+		return err
+	}
+
+	return d.logChange(e, ChangePut, key, result)
+}
+
+// GetReader returns a reader over the value of key. Chunked values are
+// streamed from the database a chunk at a time; others are read whole.
+// Like Get it checks the bloom filter and the cache first, and with
+// WithHashVerification a streamed value is hashed as it is read: the Read
+// that reaches its end returns a CorruptionError instead of io.EOF if the
+// hash does not match. Streamed values are not added to the cache. The
+// reader must be closed.
+func (d *Datastore) GetReader(key ds.Key) (io.ReadCloser, error) {
+	if d.chunks == nil {
+		value, err := d.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(value)), nil
+	}
+
+	if d.bloom != nil && d.bloom.missing(key) {
+		return nil, ds.ErrNotFound
+	}
+
+	if d.cache != nil {
+		if value, ok := d.cache.getValue(key); ok {
+			return ioutil.NopCloser(bytes.NewReader(value)), nil
+		}
+	}
+
+	var r io.ReadCloser
+	err := d.read(func(db *sql.DB) (err error) {
+		r, _, err = d.openChunked(db, key)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if d.verifyPrefix != nil {
+		r = d.verifyReader(key, r)
+	}
+
+	return r, nil
+}
+
+// chunkReader reads chunk rows in order, checking they add up to size
+type chunkReader struct {
+	txn  *sql.Tx
+	rows *sql.Rows
+	size int64
+	read int64
+	buf  []byte
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if !r.rows.Next() {
+			if err := r.rows.Err(); err != nil {
+				return 0, err
+			}
+			if r.read != r.size {
+				return 0, ErrIncompleteValue
+			}
+			return 0, io.EOF
+		}
+
+		if err := r.rows.Scan(&r.buf); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	r.read += int64(n)
+	if r.read > r.size {
+		return n, ErrIncompleteValue
+	}
+
+	return n, nil
+}
+
+func (r *chunkReader) Close() error {
+	if err := r.rows.Close(); err != nil {
+		r.txn.Rollback()
+		return err
+	}
+	return r.txn.Commit()
+}
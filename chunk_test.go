@@ -0,0 +1,278 @@
+package sqlds_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	sqlds "github.com/whyrusleeping/sql-datastore"
+)
+
+func TestChunking(t *testing.T) {
+	d, done := newDS(t, sqlds.WithChunking(sqlds.ChunkConfig{Threshold: 100, ChunkSize: 30}))
+	defer done()
+
+	large := bytes.Repeat([]byte("0123456789"), 25)
+	small := []byte("small value")
+	if err := d.Put(ds.NewKey("/large"), large); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put(ds.NewKey("/small"), small); err != nil {
+		t.Fatal(err)
+	}
+
+	var chunks int
+	if err := d.DB().QueryRow("SELECT count(*) FROM block_chunks").Scan(&chunks); err != nil {
+		t.Fatal(err)
+	}
+	if chunks != 9 {
+		t.Fatalf("expected 9 chunks, got %d", chunks)
+	}
+
+	val, err := d.Get(ds.NewKey("/large"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(val, large) {
+		t.Fatal("large value was not reassembled")
+	}
+
+	size, err := d.GetSize(ds.NewKey("/large"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != len(large) {
+		t.Fatalf("expected size %d, got %d", len(large), size)
+	}
+
+	for key, want := range map[string][]byte{"/large": large, "/small": small} {
+		r, err := d.GetReader(ds.NewKey(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("GetReader returned the wrong value for %s", key)
+		}
+	}
+
+	res, err := d.Query(dsq.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Key == "/large" && !bytes.Equal(e.Value, large) {
+			t.Fatal("query returned a partial large value")
+		}
+	}
+
+	if err := d.Delete(ds.NewKey("/large")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.DB().QueryRow("SELECT count(*) FROM block_chunks").Scan(&chunks); err != nil {
+		t.Fatal(err)
+	}
+	if chunks != 0 {
+		t.Fatalf("expected chunks to be deleted, %d left", chunks)
+	}
+}
+
+func TestChunkingDetectsMissingChunks(t *testing.T) {
+	d, done := newDS(t, sqlds.WithChunking(sqlds.ChunkConfig{Threshold: 10, ChunkSize: 4}))
+	defer done()
+
+	if err := d.Put(ds.NewKey("/large"), bytes.Repeat([]byte("x"), 20)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.DB().Exec("DELETE FROM block_chunks WHERE idx = 4"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.Get(ds.NewKey("/large")); err != sqlds.ErrIncompleteValue {
+		t.Fatal("expected ErrIncompleteValue, got", err)
+	}
+}
+
+func TestWalkChunkedOnOneConnection(t *testing.T) {
+	d, done := newDS(t, sqlds.WithChunking(sqlds.ChunkConfig{Threshold: 10, ChunkSize: 4}))
+	defer done()
+
+	large := bytes.Repeat([]byte("x"), 20)
+	for _, key := range []string{"/a", "/b"} {
+		if err := d.Put(ds.NewKey(key), large); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Put(ds.NewKey("/c"), []byte("small")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the listing must be closed before the chunks are read, or this pool
+	// waits on itself
+	d.DB().SetMaxOpenConns(1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var keys []string
+	err := d.Walk(ctx, "/", func(key ds.Key, value []byte) error {
+		keys = append(keys, key.String())
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 3 {
+		t.Fatalf("walked %v", keys)
+	}
+}
+
+func TestPutReader(t *testing.T) {
+	d, done := newDS(t, sqlds.WithChunking(sqlds.ChunkConfig{Threshold: 100, ChunkSize: 30}))
+	defer done()
+
+	ctx := context.Background()
+	large := bytes.Repeat([]byte("0123456789"), 25)
+	if err := d.PutReader(ctx, ds.NewKey("/large"), iotest.OneByteReader(bytes.NewReader(large))); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PutReader(ctx, ds.NewKey("/small"), strings.NewReader("small")); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, want := range map[string][]byte{"/large": large, "/small": []byte("small")} {
+		got, err := d.Get(ds.NewKey(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("wrong value for %s", key)
+		}
+
+		size, err := d.GetSize(ds.NewKey(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != len(want) {
+			t.Fatalf("expected size %d for %s, got %d", len(want), key, size)
+		}
+	}
+
+	// an existing key keeps its value
+	if err := d.PutReader(ctx, ds.NewKey("/large"), bytes.NewReader(bytes.Repeat([]byte("y"), 200))); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := d.Get(ds.NewKey("/large")); !bytes.Equal(got, large) {
+		t.Fatal("PutReader overwrote an existing key")
+	}
+
+	b, err := d.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb := b.(sqlds.StreamingBatch)
+	if err := sb.PutReader(ctx, ds.NewKey("/batched"), bytes.NewReader(large)); err != nil {
+		t.Fatal(err)
+	}
+	if err := sb.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := d.Get(ds.NewKey("/batched")); err != nil || !bytes.Equal(got, large) {
+		t.Fatal("batched PutReader was not stored", err)
+	}
+
+	failing := io.MultiReader(bytes.NewReader(large), iotest.ErrReader(errors.New("read failed")))
+	if err := d.PutReader(ctx, ds.NewKey("/failed"), failing); err == nil {
+		t.Fatal("expected the reader's error")
+	}
+	if has, _ := d.Has(ds.NewKey("/failed")); has {
+		t.Fatal("a failed PutReader left a partial value")
+	}
+}
+
+func TestGetReaderVerifiesHash(t *testing.T) {
+	d, done := newDS(t,
+		sqlds.WithChunking(sqlds.ChunkConfig{Threshold: 10, ChunkSize: 4}),
+		sqlds.WithHashVerification(sqlds.BlocksPrefix),
+	)
+	defer done()
+
+	data := []byte("a block that is stored in chunks")
+	k := blockKey(t, data)
+	if err := d.Put(k, data); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := d.GetReader(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("GetReader returned the wrong value")
+	}
+
+	if _, err := d.DB().Exec("UPDATE block_chunks SET data = $1 WHERE idx = 2", []byte("rot!")); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err = d.GetReader(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(r)
+	r.Close()
+	cerr, ok := err.(*sqlds.CorruptionError)
+	if !ok {
+		t.Fatal("expected CorruptionError, got:", err)
+	}
+	if !cerr.Key.Equal(k) {
+		t.Fatalf("corruption reported for %s, expected %s", cerr.Key, k)
+	}
+	if d.HashMismatches() != 1 {
+		t.Fatalf("expected 1 mismatch, got %d", d.HashMismatches())
+	}
+}
+
+func TestGetReaderUsesBloomFilter(t *testing.T) {
+	d, done := newDS(t,
+		sqlds.WithChunking(sqlds.ChunkConfig{Threshold: 10, ChunkSize: 4}),
+		sqlds.WithBloomFilter(sqlds.BloomConfig{
+			ExpectedKeys:      1000,
+			FalsePositiveRate: 0.001,
+		}),
+	)
+	defer done()
+
+	if err := d.RebuildBloomFilter(); err != nil {
+		t.Fatal(err)
+	}
+
+	// with the table gone, only answers from the filter can succeed
+	if _, err := d.DB().Exec("DROP TABLE blocks"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.GetReader(ds.NewKey("/missing")); err != ds.ErrNotFound {
+		t.Fatal("expected the bloom filter to answer without the database, got", err)
+	}
+}
@@ -0,0 +1,641 @@
+// Command sqlds inspects and maintains a postgres-backed datastore.
+//
+// Usage:
+//
+//	sqlds [connection flags] [-json] <command> [args]
+//
+// Run sqlds -h for the list of commands. There is no password flag, so that
+// the password stays out of the process list and shell history: set
+// PGPASSWORD or use a pgpass file (~/.pgpass, or the file PGPASSFILE
+// names).
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+
+	ds "github.com/ipfs/go-datastore"
+	badger "github.com/ipfs/go-ds-badger"
+	flatfs "github.com/ipfs/go-ds-flatfs"
+	leveldb "github.com/ipfs/go-ds-leveldb"
+	sqlds "github.com/whyrusleeping/sql-datastore"
+	"github.com/whyrusleeping/sql-datastore/postgres"
+)
+
+type command struct {
+	usage string
+	help  string
+	run   func(env *env, args []string) error
+}
+
+var commands map[string]*command
+
+func init() {
+	// set up in init, the commands refer back to the table for their usage
+	commands = map[string]*command{
+		"get":     {"get <key>", "print the value stored under key", runGet},
+		"put":     {"put <key> [value]", "store value, or stdin, under key", runPut},
+		"has":     {"has <key>", "report whether key exists", runHas},
+		"rm":      {"rm <key>...", "delete keys", runRm},
+		"ls":      {"ls [-prefix p] [-values]", "list keys below a prefix", runLs},
+		"stat":    {"stat [-prefix p]", "count entries and bytes below a prefix", runStat},
+		"export":  {"export [-prefix p] [file]", "write blocks to a CAR file, or stdout", runExport},
+		"import":  {"import [-batch n] [file]", "read blocks from a CAR file, or stdin", runImport},
+		"migrate": {"migrate", "create or upgrade the tables", runMigrate},
+		"verify":  {"verify [-prefix p]", "rehash blocks and report corrupt ones", runVerify},
+		"migrate-from": {"migrate-from [flags] <flatfs|leveldb|badger> <path>",
+			"copy an existing datastore into postgres", runMigrateFrom},
+	}
+}
+
+var order = []string{"get", "put", "has", "rm", "ls", "stat", "export", "import", "migrate", "migrate-from", "verify"}
+
+type env struct {
+	ctx  context.Context
+	opts postgres.Options
+	json bool
+	out  io.Writer
+
+	d *sqlds.Datastore
+}
+
+func (e *env) datastore() (*sqlds.Datastore, error) {
+	if e.d == nil {
+		d, err := e.opts.Create()
+		if err != nil {
+			return nil, err
+		}
+		e.d = d
+	}
+
+	return e.d, nil
+}
+
+// print writes v as a line of JSON in -json mode, and the result of text
+// otherwise
+func (e *env) print(v interface{}, text func() string) error {
+	if e.json {
+		return json.NewEncoder(e.out).Encode(v)
+	}
+
+	_, err := fmt.Fprintln(e.out, text())
+	return err
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: sqlds [flags] <command> [args]\n\ncommands:\n")
+	for _, name := range order {
+		c := commands[name]
+		fmt.Fprintf(os.Stderr, "  %-28s %s\n", c.usage, c.help)
+	}
+	fmt.Fprintf(os.Stderr, "\nflags:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	e := &env{out: os.Stdout}
+	flag.StringVar(&e.opts.Host, "host", os.Getenv("PGHOST"), "postgres host")
+	flag.StringVar(&e.opts.Port, "port", os.Getenv("PGPORT"), "postgres port")
+	flag.StringVar(&e.opts.User, "user", os.Getenv("PGUSER"), "postgres user")
+	flag.StringVar(&e.opts.Database, "database", os.Getenv("PGDATABASE"), "postgres database")
+	flag.StringVar(&e.opts.Namespace, "namespace", "", "only operate on the keys of this namespace")
+	flag.BoolVar(&e.json, "json", false, "print results as JSON, one object per line")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	c, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "sqlds: unknown command %q\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	go func() {
+		<-sig
+		cancel()
+	}()
+	e.ctx = ctx
+
+	err := c.run(e, flag.Args()[1:])
+	if e.d != nil {
+		e.d.Close()
+	}
+
+	if err != nil {
+		if e.json {
+			json.NewEncoder(os.Stderr).Encode(map[string]string{"error": err.Error()})
+		} else {
+			fmt.Fprintf(os.Stderr, "sqlds: %s\n", err)
+		}
+		os.Exit(1)
+	}
+}
+
+func parseArgs(name string, args []string, n int, setup func(fs *flag.FlagSet)) (*flag.FlagSet, error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	if setup != nil {
+		setup(fs)
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if n >= 0 && fs.NArg() != n {
+		return nil, fmt.Errorf("usage: sqlds %s", commands[name].usage)
+	}
+
+	return fs, nil
+}
+
+func runGet(e *env, args []string) error {
+	fs, err := parseArgs("get", args, 1, nil)
+	if err != nil {
+		return err
+	}
+
+	d, err := e.datastore()
+	if err != nil {
+		return err
+	}
+
+	key := ds.NewKey(fs.Arg(0))
+	value, err := d.Get(key)
+	if err != nil {
+		return err
+	}
+
+	if e.json {
+		return e.print(struct {
+			Key   string `json:"key"`
+			Value []byte `json:"value"`
+		}{key.String(), value}, nil)
+	}
+
+	_, err = e.out.Write(value)
+	return err
+}
+
+func runPut(e *env, args []string) error {
+	fs, err := parseArgs("put", args, -1, nil)
+	if err != nil {
+		return err
+	}
+
+	var value []byte
+	switch fs.NArg() {
+	case 1:
+		value, err = ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+	case 2:
+		value = []byte(fs.Arg(1))
+	default:
+		return fmt.Errorf("usage: sqlds %s", commands["put"].usage)
+	}
+
+	d, err := e.datastore()
+	if err != nil {
+		return err
+	}
+
+	key := ds.NewKey(fs.Arg(0))
+	if err := d.Put(key, value); err != nil {
+		return err
+	}
+
+	return e.print(struct {
+		Key  string `json:"key"`
+		Size int    `json:"size"`
+	}{key.String(), len(value)}, func() string {
+		return fmt.Sprintf("stored %d bytes under %s", len(value), key)
+	})
+}
+
+func runHas(e *env, args []string) error {
+	fs, err := parseArgs("has", args, 1, nil)
+	if err != nil {
+		return err
+	}
+
+	d, err := e.datastore()
+	if err != nil {
+		return err
+	}
+
+	key := ds.NewKey(fs.Arg(0))
+	exists, err := d.Has(key)
+	if err != nil && err != ds.ErrNotFound {
+		return err
+	}
+
+	return e.print(struct {
+		Key    string `json:"key"`
+		Exists bool   `json:"exists"`
+	}{key.String(), exists}, func() string {
+		return fmt.Sprint(exists)
+	})
+}
+
+func runRm(e *env, args []string) error {
+	fs, err := parseArgs("rm", args, -1, nil)
+	if err != nil {
+		return err
+	}
+
+	if fs.NArg() == 0 {
+		return fmt.Errorf("usage: sqlds %s", commands["rm"].usage)
+	}
+
+	d, err := e.datastore()
+	if err != nil {
+		return err
+	}
+
+	for _, arg := range fs.Args() {
+		key := ds.NewKey(arg)
+		err := d.Delete(key)
+		if err != nil && err != ds.ErrNotFound {
+			return err
+		}
+
+		deleted := err == nil
+		err = e.print(struct {
+			Key     string `json:"key"`
+			Deleted bool   `json:"deleted"`
+		}{key.String(), deleted}, func() string {
+			if deleted {
+				return "removed " + key.String()
+			}
+			return key.String() + " not found"
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func runLs(e *env, args []string) error {
+	var prefix string
+	var values bool
+	_, err := parseArgs("ls", args, 0, func(fs *flag.FlagSet) {
+		fs.StringVar(&prefix, "prefix", "", "only list keys below this prefix")
+		fs.BoolVar(&values, "values", false, "include values")
+	})
+	if err != nil {
+		return err
+	}
+
+	d, err := e.datastore()
+	if err != nil {
+		return err
+	}
+
+	if !values {
+		return walkKeys(e, d, prefix, func(key ds.Key) error {
+			if !e.json {
+				_, err := fmt.Fprintln(e.out, key)
+				return err
+			}
+
+			size, err := d.GetSize(key)
+			if err == ds.ErrNotFound {
+				// deleted since it was listed
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			return e.print(struct {
+				Key  string `json:"key"`
+				Size int    `json:"size"`
+			}{key.String(), size}, nil)
+		})
+	}
+
+	return d.Walk(e.ctx, prefix, func(key ds.Key, value []byte) error {
+		entry := struct {
+			Key   string `json:"key"`
+			Size  int    `json:"size"`
+			Value []byte `json:"value,omitempty"`
+		}{key.String(), len(value), value}
+
+		err := e.print(entry, func() string {
+			return fmt.Sprintf("%s\t%q", key, value)
+		})
+		if err != nil {
+			return err
+		}
+
+		return e.ctx.Err()
+	})
+}
+
+func runStat(e *env, args []string) error {
+	var prefix string
+	_, err := parseArgs("stat", args, 0, func(fs *flag.FlagSet) {
+		fs.StringVar(&prefix, "prefix", "", "only count keys below this prefix")
+	})
+	if err != nil {
+		return err
+	}
+
+	d, err := e.datastore()
+	if err != nil {
+		return err
+	}
+
+	var stat struct {
+		Prefix  string `json:"prefix"`
+		Entries int64  `json:"entries"`
+		Bytes   int64  `json:"bytes"`
+	}
+	stat.Prefix = prefix
+
+	err = walkKeys(e, d, prefix, func(key ds.Key) error {
+		size, err := d.GetSize(key)
+		if err == ds.ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		stat.Entries++
+		stat.Bytes += int64(size)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return e.print(stat, func() string {
+		return fmt.Sprintf("entries: %d\nbytes:   %d", stat.Entries, stat.Bytes)
+	})
+}
+
+// lsPageSize is the number of keys ls and stat read at a time
+const lsPageSize = 1000
+
+// walkKeys calls fn for every key below prefix, in key order, without
+// reading any value
+func walkKeys(e *env, d *sqlds.Datastore, prefix string, fn func(key ds.Key) error) error {
+	var after ds.Key
+	for {
+		keys, err := d.KeysAfter(prefix, after, lsPageSize)
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			if err := fn(key); err != nil {
+				return err
+			}
+		}
+
+		if len(keys) < lsPageSize {
+			return nil
+		}
+		after = keys[len(keys)-1]
+
+		if err := e.ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+func runExport(e *env, args []string) error {
+	var prefix string
+	fs, err := parseArgs("export", args, -1, func(fs *flag.FlagSet) {
+		fs.StringVar(&prefix, "prefix", sqlds.BlocksPrefix.String(), "export blocks below this prefix")
+	})
+	if err != nil {
+		return err
+	}
+
+	w := e.out
+	if fs.NArg() > 0 {
+		f, err := os.Create(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	d, err := e.datastore()
+	if err != nil {
+		return err
+	}
+
+	var p sqlds.CarProgress
+	err = d.Export(e.ctx, prefix, w, sqlds.CarProgressFunc(func(cp sqlds.CarProgress) {
+		p = cp
+	}))
+	if err != nil {
+		return err
+	}
+
+	if fs.NArg() == 0 {
+		// stdout holds the CAR, keep the summary out of it
+		e.out = os.Stderr
+	}
+
+	return e.print(p, func() string {
+		return fmt.Sprintf("exported %d blocks (%d bytes), skipped %d keys", p.Blocks, p.Bytes, p.Skipped)
+	})
+}
+
+func runImport(e *env, args []string) error {
+	var batch int
+	fs, err := parseArgs("import", args, -1, func(fs *flag.FlagSet) {
+		fs.IntVar(&batch, "batch", 1000, "blocks per transaction")
+	})
+	if err != nil {
+		return err
+	}
+
+	var r io.Reader = os.Stdin
+	if fs.NArg() > 0 {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	d, err := e.datastore()
+	if err != nil {
+		return err
+	}
+
+	var p sqlds.CarProgress
+	err = d.Import(e.ctx, r, sqlds.CarBatchSize(batch), sqlds.CarProgressFunc(func(cp sqlds.CarProgress) {
+		p = cp
+	}))
+	if err != nil {
+		return err
+	}
+
+	return e.print(p, func() string {
+		return fmt.Sprintf("imported %d blocks (%d bytes)", p.Blocks, p.Bytes)
+	})
+}
+
+func runMigrate(e *env, args []string) error {
+	if _, err := parseArgs("migrate", args, 0, nil); err != nil {
+		return err
+	}
+
+	db, err := e.opts.Open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := postgres.Migrate(db); err != nil {
+		return err
+	}
+
+	return e.print(struct {
+		Statements int `json:"statements"`
+	}{len(postgres.Schema)}, func() string {
+		return fmt.Sprintf("applied %d schema statements", len(postgres.Schema))
+	})
+}
+
+func runVerify(e *env, args []string) error {
+	var prefix string
+	_, err := parseArgs("verify", args, 0, func(fs *flag.FlagSet) {
+		fs.StringVar(&prefix, "prefix", sqlds.BlocksPrefix.String(), "verify blocks directly below this prefix")
+	})
+	if err != nil {
+		return err
+	}
+
+	d, err := e.datastore()
+	if err != nil {
+		return err
+	}
+
+	var printErr error
+	var corrupt int64
+	checked, err := d.Verify(e.ctx, ds.NewKey(prefix), func(cerr *sqlds.CorruptionError) {
+		corrupt++
+		if printErr != nil {
+			return
+		}
+		printErr = e.print(struct {
+			Key      string `json:"key"`
+			Expected string `json:"expected"`
+			Actual   string `json:"actual"`
+		}{cerr.Key.String(), cerr.Expected.B58String(), cerr.Actual.B58String()}, func() string {
+			return "corrupt: " + cerr.Key.String()
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if printErr != nil {
+		return printErr
+	}
+
+	err = e.print(struct {
+		Checked int64 `json:"checked"`
+		Corrupt int64 `json:"corrupt"`
+	}{checked, corrupt}, func() string {
+		return fmt.Sprintf("checked %d blocks, %d corrupt", checked, corrupt)
+	})
+	if err != nil {
+		return err
+	}
+
+	if corrupt > 0 {
+		return fmt.Errorf("%d corrupt blocks", corrupt)
+	}
+
+	return nil
+}
+
+func openSource(kind, path string) (ds.Datastore, error) {
+	switch kind {
+	case "flatfs":
+		return flatfs.Open(path, false)
+	case "leveldb":
+		return leveldb.NewDatastore(path, nil)
+	case "badger":
+		return badger.NewDatastore(path, nil)
+	default:
+		return nil, fmt.Errorf("unknown datastore type %q", kind)
+	}
+}
+
+func runMigrateFrom(e *env, args []string) error {
+	cfg := sqlds.DefaultMigrateConfig
+	var prefix string
+	var noVerify bool
+	fs, err := parseArgs("migrate-from", args, 2, func(fs *flag.FlagSet) {
+		fs.StringVar(&prefix, "prefix", "/", "prepend this prefix to every key, e.g. /blocks for flatfs")
+		fs.IntVar(&cfg.BatchSize, "batch", cfg.BatchSize, "entries per transaction")
+		fs.IntVar(&cfg.Workers, "workers", cfg.Workers, "batches copied concurrently")
+		fs.BoolVar(&noVerify, "no-verify", false, "skip comparing the copy with the source")
+	})
+	if err != nil {
+		return err
+	}
+	cfg.Prefix = ds.NewKey(prefix)
+	cfg.Verify = !noVerify
+
+	src, err := openSource(fs.Arg(0), fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	if c, ok := src.(io.Closer); ok {
+		defer c.Close()
+	}
+
+	d, err := e.datastore()
+	if err != nil {
+		return err
+	}
+
+	p, err := d.MigrateFrom(e.ctx, src, cfg)
+	if merr, ok := err.(*sqlds.MismatchError); ok {
+		for _, key := range merr.Keys {
+			perr := e.print(struct {
+				Mismatch string `json:"mismatch"`
+			}{key.String()}, func() string {
+				return "mismatch: " + key.String()
+			})
+			if perr != nil {
+				return perr
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	return e.print(p, func() string {
+		return fmt.Sprintf("copied %d entries (%d bytes), verified %d", p.Copied, p.Bytes, p.Verified)
+	})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	sqlds "github.com/whyrusleeping/sql-datastore"
+	"github.com/whyrusleeping/sql-datastore/internal/testdb"
+	"github.com/whyrusleeping/sql-datastore/postgres"
+)
+
+// newEnv returns an env whose datastore is a fresh test database, and the
+// buffer its output goes to
+func newEnv(t *testing.T, json bool) (*env, *bytes.Buffer, func()) {
+	db, cleanup := testdb.Open(t, "")
+	out := &bytes.Buffer{}
+	e := &env{
+		ctx:  context.Background(),
+		json: json,
+		out:  out,
+		d:    sqlds.NewDatastore(db, postgres.Queries{}),
+	}
+	return e, out, cleanup
+}
+
+func run(t *testing.T, e *env, out *bytes.Buffer, name string, args ...string) string {
+	out.Reset()
+	if err := commands[name].run(e, args); err != nil {
+		t.Fatalf("%s %v: %s", name, args, err)
+	}
+	return out.String()
+}
+
+func TestCommands(t *testing.T) {
+	e, out, done := newEnv(t, false)
+	defer done()
+
+	if got := run(t, e, out, "put", "/a/one", "1"); got != "stored 1 bytes under /a/one\n" {
+		t.Fatalf("unexpected put output: %q", got)
+	}
+	run(t, e, out, "put", "/a/two", "22")
+	run(t, e, out, "put", "/b", "333")
+
+	if got := run(t, e, out, "get", "/a/two"); got != "22" {
+		t.Fatalf("unexpected get output: %q", got)
+	}
+	if got := run(t, e, out, "has", "/b"); got != "true\n" {
+		t.Fatalf("unexpected has output: %q", got)
+	}
+
+	if got := run(t, e, out, "ls", "-prefix", "/a"); got != "/a/one\n/a/two\n" {
+		t.Fatalf("unexpected ls output: %q", got)
+	}
+	if got := run(t, e, out, "ls", "-prefix", "/a", "-values"); got != "/a/one\t\"1\"\n/a/two\t\"22\"\n" {
+		t.Fatalf("unexpected ls -values output: %q", got)
+	}
+	if got := run(t, e, out, "stat"); got != "entries: 3\nbytes:   6\n" {
+		t.Fatalf("unexpected stat output: %q", got)
+	}
+
+	if got := run(t, e, out, "rm", "/b", "/missing"); got != "removed /b\n/missing not found\n" {
+		t.Fatalf("unexpected rm output: %q", got)
+	}
+	if has, _ := e.d.Has(ds.NewKey("/b")); has {
+		t.Fatal("rm left the key behind")
+	}
+
+	if err := commands["get"].run(e, nil); err == nil || !strings.Contains(err.Error(), "usage") {
+		t.Fatal("expected a usage error, got", err)
+	}
+}
+
+func TestCommandsJSON(t *testing.T) {
+	e, out, done := newEnv(t, true)
+	defer done()
+
+	run(t, e, out, "put", "/a/one", "1")
+	run(t, e, out, "put", "/a/two", "22")
+
+	if got := run(t, e, out, "ls", "-prefix", "/a"); got != `{"key":"/a/one","size":1}`+"\n"+`{"key":"/a/two","size":2}`+"\n" {
+		t.Fatalf("unexpected ls output: %q", got)
+	}
+	if got := run(t, e, out, "stat", "-prefix", "/a/t"); got != `{"prefix":"/a/t","entries":1,"bytes":2}`+"\n" {
+		t.Fatalf("unexpected stat output: %q", got)
+	}
+	if got := run(t, e, out, "has", "/a/three"); got != `{"key":"/a/three","exists":false}`+"\n" {
+		t.Fatalf("unexpected has output: %q", got)
+	}
+}
+
+func TestVerifyCommand(t *testing.T) {
+	e, out, done := newEnv(t, false)
+	defer done()
+
+	run(t, e, out, "put", "/blocks/not-a-hash", "x")
+	if got := run(t, e, out, "verify"); got != "checked 1 blocks, 0 corrupt\n" {
+		t.Fatalf("unexpected verify output: %q", got)
+	}
+}
@@ -0,0 +1,231 @@
+package sqlds
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// DedupQueries are the statements needed to store each distinct value once.
+// Values live in a content table keyed by their hash, which counts the keys
+// referencing it. Rows without a content reference keep their value inline,
+// so dedup can be enabled on an existing table.
+type DedupQueries interface {
+	// PutDedup inserts key ($1) referencing content hash ($2), unless the
+	// key exists
+	PutDedup() string
+	// AddRef inserts data ($2) under hash ($1) with one reference, or adds
+	// a reference if the hash is stored already
+	AddRef() string
+	// DeleteDedup deletes key ($1), selecting the content hash it
+	// referenced or NULL
+	DeleteDedup() string
+	// Release drops a reference from hash ($1)
+	Release() string
+	// GetDedup selects the value of key ($1)
+	GetDedup() string
+	// GetSizeDedup selects the length of the value of key ($1)
+	GetSizeDedup() string
+	// QueryDedup selects key and value, and accepts the Prefix, Limit and
+	// Offset suffixes
+	QueryDedup() string
+	// DiskUsageDedup selects the total size of all keys and their values
+	DiskUsageDedup() string
+	// DeleteOrphans deletes content that is no longer referenced
+	DeleteOrphans() string
+}
+
+// DedupConfig configures content deduplication
+type DedupConfig struct {
+	// CleanupInterval is how often unreferenced content is removed in the
+	// background. Zero leaves it to CleanupOrphans.
+	CleanupInterval time.Duration
+}
+
+// DefaultDedupConfig removes orphaned content every ten minutes
+var DefaultDedupConfig = DedupConfig{
+	CleanupInterval: 10 * time.Minute,
+}
+
+type dedup struct {
+	cfg  DedupConfig
+	stop chan struct{}
+}
+
+// WithDedup stores values in a content table keyed by their sha256, so
+// that keys with the same value share one copy. Reference counts are kept
+// in the transaction of every Put, Delete and batch; content whose count
+// drops to zero is removed by CleanupOrphans rather than straight away, so
+// deletes do not contend on popular values. Once values have been stored
+// deduplicated the datastore must keep using this option. It cannot be
+// combined with WithEncryption, and the Datastore's Queries must implement
+// DedupQueries.
+func WithDedup(cfg DedupConfig) Option {
+	return func(d *Datastore) {
+		d.dedup = &dedup{cfg: cfg, stop: make(chan struct{})}
+	}
+}
+
+func (c *dedup) start(d *Datastore) {
+	if c.cfg.CleanupInterval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(c.cfg.CleanupInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := d.CleanupOrphans(); err != nil {
+					log.Printf("sqlds: removing orphaned content: %s", err)
+				}
+			case <-c.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (c *dedup) close() {
+	close(c.stop)
+}
+
+func (d *Datastore) dedupQueries() (DedupQueries, error) {
+	if d.invalid != nil {
+		return nil, d.invalid
+	}
+
+	dq, ok := d.queries.(DedupQueries)
+	if !ok {
+		return nil, fmt.Errorf("sqlds: %T does not support dedup", d.queries)
+	}
+
+	return dq, nil
+}
+
+func (d *Datastore) putDedup(e execer, key ds.Key, value []byte) (sql.Result, error) {
+	dq, err := d.dedupQueries()
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256(value)
+	result, err := e.Exec(dq.PutDedup(), key.String(), hash[:])
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil || rows == 0 {
+		// the key exists and keeps its value
+		return result, err
+	}
+
+	if _, err := e.Exec(dq.AddRef(), hash[:], value); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// rowsAffected is the sql.Result of a statement read with QueryRow
+type rowsAffected int64
+
+func (r rowsAffected) LastInsertId() (int64, error) {
+	return 0, errors.New("sqlds: LastInsertId is not supported")
+}
+
+func (r rowsAffected) RowsAffected() (int64, error) {
+	return int64(r), nil
+}
+
+func (d *Datastore) deleteDedup(e execer, key ds.Key) (sql.Result, error) {
+	dq, err := d.dedupQueries()
+	if err != nil {
+		return nil, err
+	}
+
+	var hash []byte
+	switch err := e.QueryRow(dq.DeleteDedup(), key.String()).Scan(&hash); err {
+	case sql.ErrNoRows:
+		return rowsAffected(0), nil
+	case nil:
+	default:
+		return nil, err
+	}
+
+	if hash != nil {
+		if _, err := e.Exec(dq.Release(), hash); err != nil {
+			return nil, err
+		}
+	}
+
+	return rowsAffected(1), nil
+}
+
+func (d *Datastore) getDedup(db *sql.DB, key ds.Key) ([]byte, error) {
+	dq, err := d.dedupQueries()
+	if err != nil {
+		return nil, err
+	}
+
+	row := db.QueryRow(dq.GetDedup(), key.String())
+	var out []byte
+
+	switch err := row.Scan(&out); err {
+	case sql.ErrNoRows:
+		return nil, ds.ErrNotFound
+	case nil:
+		return out, nil
+	default:
+		return nil, err
+	}
+}
+
+func (d *Datastore) getSizeDedup(db *sql.DB, key ds.Key) (int, error) {
+	dq, err := d.dedupQueries()
+	if err != nil {
+		return 0, err
+	}
+
+	row := db.QueryRow(dq.GetSizeDedup(), key.String())
+	var size int
+
+	switch err := row.Scan(&size); err {
+	case sql.ErrNoRows:
+		return -1, ds.ErrNotFound
+	case nil:
+		return size, nil
+	default:
+		return 0, err
+	}
+}
+
+// CleanupOrphans removes content no key references any more and returns
+// how many values were removed
+func (d *Datastore) CleanupOrphans() (int64, error) {
+	dq, err := d.dedupQueries()
+	if err != nil {
+		return 0, err
+	}
+
+	var removed int64
+	err = d.guard(func() error {
+		result, err := d.db.Exec(dq.DeleteOrphans())
+		if err != nil {
+			return err
+		}
+
+		removed, err = result.RowsAffected()
+		return err
+	})
+
+	return removed, err
+}
@@ -0,0 +1,118 @@
+package sqlds_test
+
+import (
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	sqlds "github.com/whyrusleeping/sql-datastore"
+	"github.com/whyrusleeping/sql-datastore/postgres"
+)
+
+func contentRefs(t *testing.T, d *sqlds.Datastore) (rows, refs int) {
+	row := d.DB().QueryRow("SELECT count(*), coalesce(sum(refs), 0) FROM block_contents")
+	if err := row.Scan(&rows, &refs); err != nil {
+		t.Fatal(err)
+	}
+	return rows, refs
+}
+
+func TestDedup(t *testing.T) {
+	d, done := newDS(t, sqlds.WithDedup(sqlds.DedupConfig{}))
+	defer done()
+
+	a, b, c := ds.NewKey("/a"), ds.NewKey("/b"), ds.NewKey("/c")
+	for _, k := range []ds.Key{a, b, c} {
+		if err := d.Put(k, []byte("shared value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// putting an existing key keeps its value and its reference
+	if err := d.Put(a, []byte("shared value")); err != nil {
+		t.Fatal(err)
+	}
+
+	if rows, refs := contentRefs(t, d); rows != 1 || refs != 3 {
+		t.Fatalf("expected one value with 3 references, got %d values with %d", rows, refs)
+	}
+
+	val, err := d.Get(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(val) != "shared value" {
+		t.Fatalf("wrong value: %s", val)
+	}
+	size, err := d.GetSize(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != len("shared value") {
+		t.Fatalf("wrong size: %d", size)
+	}
+
+	batch, err := d.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.Delete(a); err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.Delete(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete(c); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete(c); err != ds.ErrNotFound {
+		t.Fatal("expected ErrNotFound deleting twice, got", err)
+	}
+
+	if rows, refs := contentRefs(t, d); rows != 1 || refs != 0 {
+		t.Fatalf("expected one orphaned value, got %d values with %d references", rows, refs)
+	}
+
+	removed, err := d.CleanupOrphans()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Fatalf("expected 1 orphan removed, got %d", removed)
+	}
+	if rows, _ := contentRefs(t, d); rows != 0 {
+		t.Fatalf("expected no stored values, got %d", rows)
+	}
+}
+
+func TestDedupReadsInlineValues(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	if err := d.Put(ds.NewKey("/inline"), []byte("stored before dedup")); err != nil {
+		t.Fatal(err)
+	}
+
+	dd := sqlds.NewDatastore(d.DB(), postgres.Queries{}, sqlds.WithDedup(sqlds.DedupConfig{}))
+	val, err := dd.Get(ds.NewKey("/inline"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(val) != "stored before dedup" {
+		t.Fatalf("wrong value: %s", val)
+	}
+
+	if err := dd.Delete(ds.NewKey("/inline")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDedupWithEncryption(t *testing.T) {
+	d, done := newDS(t, sqlds.WithDedup(sqlds.DedupConfig{}), sqlds.WithEncryption(newTestKeyring(t, "k1", 1)))
+	defer done()
+
+	if err := d.Put(ds.NewKey("/a"), []byte("x")); err == nil {
+		t.Fatal("expected dedup and encryption to be refused together")
+	}
+}
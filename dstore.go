@@ -1,10 +1,11 @@
 package sqlds
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
-	"log"
+	"strings"
 
 	ds "github.com/ipfs/go-datastore"
 	dsq "github.com/ipfs/go-datastore/query"
@@ -16,6 +17,8 @@ type Queries interface {
 	Get() string
 	Put() string
 	Query() string
+	// Prefix is formatted with the query prefix, its LIKE wildcards
+	// escaped with a backslash and its single quotes doubled
 	Prefix() string
 	Limit() string
 	Offset() string
@@ -23,19 +26,102 @@ type Queries interface {
 }
 
 type Datastore struct {
+	// accessed atomically, kept first for 64-bit alignment
+	mismatches uint64
+
 	db      *sql.DB
 	queries Queries
+	keyring *Keyring
+	// plaintext rows are readable while encryption is being enabled
+	plaintext bool
+
+	verifyPrefix *ds.Key
+
+	replicas    *replicaSet
+	retryPolicy *RetryPolicy
+	breaker     *Breaker
+	cache       *cache
+	bloom       *bloom
+	changelog   *changelog
+	dedup       *dedup
+	chunks      *ChunkConfig
+	versions    *versions
+	softDelete  *softDelete
+	audit       *audit
+
+	// invalid is set when the options cannot be combined; every
+	// operation fails with it
+	invalid error
+}
+
+// Option configures optional Datastore behaviour
+type Option func(*Datastore)
+
+// NewDatastore returns a new datastore. If opts cannot be combined, every
+// operation of the datastore fails with an error saying why.
+func NewDatastore(db *sql.DB, queries Queries, opts ...Option) *Datastore {
+	d := &Datastore{db: db, queries: queries}
+	for _, opt := range opts {
+		opt(d)
+	}
+
+	d.invalid = d.checkOptions()
+	if d.invalid != nil {
+		return d
+	}
+
+	if d.bloom != nil {
+		d.bloom.start(d)
+	}
+
+	if d.changelog != nil {
+		d.changelog.start(d)
+	}
+
+	if d.dedup != nil {
+		d.dedup.start(d)
+	}
+
+	if d.versions != nil {
+		d.versions.start(d)
+	}
+
+	if d.softDelete != nil {
+		d.softDelete.start(d)
+	}
+
+	return d
 }
 
-// NewDatastore returns a new datastore
-func NewDatastore(db *sql.DB, queries Queries) *Datastore {
-	return &Datastore{db: db, queries: queries}
+// checkOptions rejects the options that store values in incompatible
+// ways. Chunking, dedup and encryption each change where and how a value
+// is stored, so at most one of them can be used.
+func (d *Datastore) checkOptions() error {
+	switch {
+	case d.chunks != nil && (d.keyring != nil || d.dedup != nil || d.versions != nil):
+		return errors.New("sqlds: chunking cannot be combined with encryption, dedup or versioning")
+	case d.dedup != nil && d.keyring != nil:
+		return errors.New("sqlds: dedup cannot be combined with encryption")
+	case d.versions != nil && d.keyring != nil:
+		return errors.New("sqlds: versioning cannot be combined with encryption")
+	case d.softDelete != nil && (d.dedup != nil || d.chunks != nil):
+		return errors.New("sqlds: soft delete cannot be combined with dedup or chunking")
+	}
+
+	return nil
 }
 
 type batch struct {
-	db      *sql.DB
-	queries Queries
-	txn     *sql.Tx
+	ds  *Datastore
+	txn *sql.Tx
+	// log is txn, holding change log entries back until Commit
+	log *deferredLog
+	ctx context.Context
+
+	// keys written in this batch, used to update caches on commit
+	touched []ds.Key
+	// audit events of the writes in this batch, handed to the sink on commit
+	events []AuditEvent
 }
 
 func (b *batch) GetTransaction() (*sql.Tx, error) {
@@ -43,7 +129,11 @@ func (b *batch) GetTransaction() (*sql.Tx, error) {
 		return b.txn, nil
 	}
 
-	newTransaction, err := b.db.Begin()
+	var newTransaction *sql.Tx
+	err := b.ds.guard(func() (err error) {
+		newTransaction, err = b.ds.db.Begin()
+		return err
+	})
 	if err != nil {
 		if newTransaction != nil {
 			newTransaction.Rollback()
@@ -53,6 +143,7 @@ func (b *batch) GetTransaction() (*sql.Tx, error) {
 	}
 
 	b.txn = newTransaction
+	b.log = &deferredLog{Tx: newTransaction}
 	return newTransaction, nil
 }
 
@@ -61,70 +152,178 @@ func (b *batch) Put(key ds.Key, val []byte) error {
 		return ds.ErrInvalidType
 	}
 
-	txn, err := b.GetTransaction()
-	if err != nil {
-		b.txn.Rollback()
+	if _, err := b.GetTransaction(); err != nil {
 		return err
 	}
 
-	_, err = txn.Exec(b.queries.Put(), key.String(), val)
+	if b.ds.bloom != nil {
+		b.ds.bloom.add(key)
+	}
+
+	var ev AuditEvent
+	if b.ds.audit != nil {
+		ev = b.ds.auditEvent(b.ctx, AuditPut, key, int64(len(val)))
+	}
+
+	err := b.ds.guard(func() error {
+		if err := b.ds.put(b.log, key, val); err != nil {
+			return err
+		}
+		return b.ds.recordAudit(b.log, ev)
+	})
 	if err != nil {
 		b.txn.Rollback()
 		return err
 	}
 
+	b.touched = append(b.touched, key)
+	if b.ds.audit != nil {
+		b.events = append(b.events, ev)
+	}
 	return nil
 }
 
 func (b *batch) Delete(key ds.Key) error {
-	txn, err := b.GetTransaction()
-	if err != nil {
-		b.txn.Rollback()
+	if _, err := b.GetTransaction(); err != nil {
+		return err
+	}
+
+	var ev AuditEvent
+	if b.ds.audit != nil {
+		ev = b.ds.auditEvent(b.ctx, AuditDelete, key, 0)
 	}
 
-	_, err = txn.Exec(b.queries.Delete(), key.String())
+	var rows int64
+	err := b.ds.guard(func() error {
+		result, err := b.ds.delete(b.log, key)
+		if err != nil {
+			return err
+		}
+		if rows, err = result.RowsAffected(); err != nil || rows == 0 {
+			return err
+		}
+		return b.ds.recordAudit(b.log, ev)
+	})
 	if err != nil {
 		b.txn.Rollback()
 		return err
 	}
 
-	return err
+	b.touched = append(b.touched, key)
+	if b.ds.audit != nil && rows > 0 {
+		b.events = append(b.events, ev)
+	}
+	return nil
 }
 
 func (b *batch) Commit() error {
 	if b.txn == nil {
 		return errors.New("no transaction started, cannot commit")
 	}
-	var err = b.txn.Commit()
+
+	if b.ds.audit != nil {
+		ev := b.ds.auditEvent(b.ctx, AuditCommit, ds.Key{}, int64(len(b.events)))
+		if err := b.ds.guard(func() error { return b.ds.recordAudit(b.txn, ev) }); err != nil {
+			b.txn.Rollback()
+			return err
+		}
+		b.events = append(b.events, ev)
+	}
+
+	if err := b.ds.guard(func() error { return b.ds.flushChanges(b.log) }); err != nil {
+		b.txn.Rollback()
+		return err
+	}
+
+	var err = b.ds.guard(b.txn.Commit)
 	if err != nil {
 		b.txn.Rollback()
 		return err
 	}
 
+	b.ds.emitAudit(b.events...)
+
+	if b.ds.cache != nil {
+		b.ds.cache.invalidate(b.touched...)
+	}
+
+	if b.ds.bloom != nil {
+		// a rebuild may have started since the keys were first added
+		b.ds.bloom.add(b.touched...)
+	}
+
 	return nil
 }
 
 func (d *Datastore) Batch() (ds.Batch, error) {
 	batch := &batch{
-		db:      d.db,
-		queries: d.queries,
-		txn:     nil,
+		ds:  d,
+		txn: nil,
+		ctx: context.Background(),
 	}
 
 	return batch, nil
 }
 
 func (d *Datastore) Close() error {
+	if d.bloom != nil {
+		d.bloom.close()
+	}
+
+	if d.changelog != nil {
+		d.changelog.close()
+	}
+
+	if d.dedup != nil {
+		d.dedup.close()
+	}
+
+	if d.versions != nil {
+		d.versions.close()
+	}
+
+	if d.softDelete != nil {
+		d.softDelete.close()
+	}
+
+	if d.replicas != nil {
+		if err := d.replicas.close(); err != nil {
+			d.db.Close()
+			return err
+		}
+	}
+
 	return d.db.Close()
 }
 
 func (d *Datastore) Delete(key ds.Key) error {
-	result, err := d.db.Exec(d.queries.Delete(), key.String())
-	if err != nil {
-		return err
+	return d.deleteContext(context.Background(), key)
+}
+
+func (d *Datastore) deleteContext(ctx context.Context, key ds.Key) error {
+	var ev AuditEvent
+	if d.audit != nil {
+		ev = d.auditEvent(ctx, AuditDelete, key, 0)
+	}
+
+	var rows int64
+	err := d.guard(func() error {
+		return d.write(func(e execer) error {
+			result, err := d.delete(e, key)
+			if err != nil {
+				return err
+			}
+			if rows, err = result.RowsAffected(); err != nil || rows == 0 {
+				return err
+			}
+			return d.recordAudit(e, ev)
+		})
+	})
+
+	if d.cache != nil {
+		d.cache.invalidate(key)
 	}
 
-	rows, err := result.RowsAffected()
 	if err != nil {
 		return err
 	}
@@ -133,11 +332,56 @@ func (d *Datastore) Delete(key ds.Key) error {
 		return ds.ErrNotFound
 	}
 
+	d.emitAudit(ev)
 	return nil
 }
 
 func (d *Datastore) Get(key ds.Key) (value []byte, err error) {
-	row := d.db.QueryRow(d.queries.Get(), key.String())
+	if d.bloom != nil && d.bloom.missing(key) {
+		return nil, ds.ErrNotFound
+	}
+
+	if d.cache != nil {
+		if value, ok := d.cache.getValue(key); ok {
+			return value, nil
+		}
+	}
+
+	err = d.read(func(db *sql.DB) error {
+		value, err = d.get(db, key)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if d.verifyPrefix != nil {
+		if err := d.verify(key, value); err != nil {
+			return nil, err
+		}
+	}
+
+	if d.cache != nil {
+		d.cache.addValue(key, value)
+	}
+
+	return value, nil
+}
+
+func (d *Datastore) get(db *sql.DB, key ds.Key) ([]byte, error) {
+	if d.chunks != nil {
+		return d.getChunked(db, key)
+	}
+
+	if d.dedup != nil {
+		return d.getDedup(db, key)
+	}
+
+	if d.keyring != nil {
+		return d.getEncrypted(db, key)
+	}
+
+	row := db.QueryRow(d.queries.Get(), key.String())
 	var out []byte
 
 	switch err := row.Scan(&out); err {
@@ -151,7 +395,35 @@ func (d *Datastore) Get(key ds.Key) (value []byte, err error) {
 }
 
 func (d *Datastore) Has(key ds.Key) (exists bool, err error) {
-	row := d.db.QueryRow(d.queries.Exists(), key.String())
+	if d.bloom != nil && d.bloom.missing(key) {
+		return false, nil
+	}
+
+	if d.cache != nil && d.cache.has(key) {
+		return true, nil
+	}
+
+	err = d.read(func(db *sql.DB) error {
+		exists, err = d.has(db, key)
+		if err == nil && !exists {
+			return ds.ErrNotFound
+		}
+		return err
+	})
+
+	if err == ds.ErrNotFound {
+		return false, nil
+	}
+
+	if err == nil && d.cache != nil {
+		d.cache.addExists(key)
+	}
+
+	return exists, err
+}
+
+func (d *Datastore) has(db *sql.DB, key ds.Key) (exists bool, err error) {
+	row := db.QueryRow(d.queries.Exists(), key.String())
 
 	switch err := row.Scan(&exists); err {
 	case sql.ErrNoRows:
@@ -164,20 +436,159 @@ func (d *Datastore) Has(key ds.Key) (exists bool, err error) {
 }
 
 func (d *Datastore) Put(key ds.Key, value []byte) error {
+	return d.putContext(context.Background(), key, value)
+}
+
+func (d *Datastore) putContext(ctx context.Context, key ds.Key, value []byte) error {
 	if value == nil {
 		return ds.ErrInvalidType
 	}
 
-	_, err := d.db.Exec(d.queries.Put(), key.String(), value)
+	if d.cache != nil {
+		defer d.cache.invalidate(key)
+	}
+
+	if d.bloom != nil {
+		// add before writing so the key is never in the table but not in
+		// the filter, and again after in case a rebuild started meanwhile
+		d.bloom.add(key)
+		defer d.bloom.add(key)
+	}
+
+	var ev AuditEvent
+	if d.audit != nil {
+		ev = d.auditEvent(ctx, AuditPut, key, int64(len(value)))
+	}
+
+	put := func() error {
+		return d.guard(func() error {
+			return d.write(func(e execer) error {
+				if err := d.put(e, key, value); err != nil {
+					return err
+				}
+				return d.recordAudit(e, ev)
+			})
+		})
+	}
+
+	var err error
+	if isBlockKey(key) {
+		err = d.retry(put)
+	} else {
+		err = put()
+	}
+
+	if err == nil {
+		d.emitAudit(ev)
+	}
+
+	return err
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// multiTable reports whether a single write may touch more than one table
+func (d *Datastore) multiTable() bool {
+	return d.changelog != nil || d.dedup != nil || d.chunks != nil ||
+		d.versions != nil || d.softDelete != nil ||
+		(d.audit != nil && d.audit.cfg.Sink == nil)
+}
+
+// write runs fn in a transaction when a single write has to touch more
+// than one table, and directly against the database otherwise
+func (d *Datastore) write(fn func(e execer) error) error {
+	if !d.multiTable() {
+		return fn(d.db)
+	}
+
+	txn, err := d.db.Begin()
 	if err != nil {
 		return err
 	}
 
-	return nil
+	t := &deferredLog{Tx: txn}
+	if err := fn(t); err != nil {
+		txn.Rollback()
+		return err
+	}
+
+	if err := d.flushChanges(t); err != nil {
+		txn.Rollback()
+		return err
+	}
+
+	return txn.Commit()
+}
+
+func (d *Datastore) put(e execer, key ds.Key, value []byte) error {
+	var result sql.Result
+	var err error
+
+	if d.versions != nil {
+		if err := d.overwrite(e, key); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case d.chunks != nil:
+		result, err = d.putChunked(e, key, value)
+	case d.dedup != nil:
+		result, err = d.putDedup(e, key, value)
+	case d.keyring != nil:
+		result, err = d.putEncrypted(e, key, value)
+	default:
+		result, err = e.Exec(d.queries.Put(), key.String(), value)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if err := d.recordVersion(e, key, value, result); err != nil {
+		return err
+	}
+
+	return d.logChange(e, ChangePut, key, result)
+}
+
+func (d *Datastore) delete(e execer, key ds.Key) (sql.Result, error) {
+	var result sql.Result
+	var err error
+
+	switch {
+	case d.softDelete != nil:
+		result, err = d.deleteSoft(e, key)
+	case d.chunks != nil:
+		result, err = d.deleteChunked(e, key)
+	case d.dedup != nil:
+		result, err = d.deleteDedup(e, key)
+	default:
+		result, err = e.Exec(d.queries.Delete(), key.String())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := d.recordVersion(e, key, nil, result); err != nil {
+		return nil, err
+	}
+
+	return result, d.logChange(e, ChangeDelete, key, result)
 }
 
 func (d *Datastore) Query(q dsq.Query) (dsq.Results, error) {
-	raw, err := d.RawQuery(q)
+	var raw dsq.Results
+	err := d.retry(func() error {
+		return d.guardRead(func(db *sql.DB) (err error) {
+			raw, err = d.rawQuery(db, q)
+			return err
+		})
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -186,21 +597,33 @@ func (d *Datastore) Query(q dsq.Query) (dsq.Results, error) {
 		raw = dsq.NaiveFilter(raw, f)
 	}
 
-	for _, o := range q.Orders {
-		raw = dsq.NaiveOrder(raw, o)
-	}
-
-	return raw, nil
+	return dsq.NaiveOrder(raw, q.Orders...), nil
 }
 
 func (d *Datastore) RawQuery(q dsq.Query) (dsq.Results, error) {
-	var rows *sql.Rows
-	var err error
+	return d.rawQuery(d.reader(), q)
+}
+
+func (d *Datastore) rawQuery(db *sql.DB, q dsq.Query) (dsq.Results, error) {
+	switch {
+	case d.chunks != nil:
+		return d.rawQueryChunked(db, q)
+	case d.dedup != nil:
+		// read below, with the dedup base query
+	case d.keyring != nil:
+		return d.rawQueryEncrypted(db, q)
+	}
 
+	base, err := d.baseQuery()
+	if err != nil {
+		return nil, err
+	}
+
+	var rows *sql.Rows
 	if q.Prefix != "" {
-		rows, err = QueryWithParams(d, q)
+		rows, err = db.Query(d.withParams(base, q))
 	} else {
-		rows, err = d.db.Query(d.queries.Query())
+		rows, err = db.Query(base)
 	}
 
 	if err != nil {
@@ -213,10 +636,8 @@ func (d *Datastore) RawQuery(q dsq.Query) (dsq.Results, error) {
 	for rows.Next() {
 		var key string
 		var out []byte
-		err := rows.Scan(&key, &out)
-
-		if err != nil {
-			log.Fatal("Error reading rows from query")
+		if err := rows.Scan(&key, &out); err != nil {
+			return nil, err
 		}
 
 		entry := dsq.Entry{
@@ -227,12 +648,108 @@ func (d *Datastore) RawQuery(q dsq.Query) (dsq.Results, error) {
 		entries = append(entries, entry)
 	}
 
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
 	results := dsq.ResultsWithEntries(q, entries)
 	return results, nil
 }
 
-func (d *Datastore) GetSize(key ds.Key) (int, error) {
-	row := d.db.QueryRow(d.queries.GetSize(), key.String())
+// Walk calls fn for every entry below prefix, stopping at the first error
+// fn returns. Unlike Query it streams rows instead of loading them all.
+func (d *Datastore) Walk(ctx context.Context, prefix string, fn func(key ds.Key, value []byte) error) error {
+	return d.guardRead(func(db *sql.DB) error {
+		return d.scan(ctx, db, prefix, func(key string, value []byte) error {
+			return fn(ds.RawKey(key), value)
+		})
+	})
+}
+
+// scan streams every entry below prefix in db to fn without buffering the
+// result set, stopping at the first error fn returns
+func (d *Datastore) scan(ctx context.Context, db *sql.DB, prefix string, fn func(key string, value []byte) error) error {
+	if d.chunks != nil {
+		return d.scanChunked(ctx, db, prefix, fn)
+	}
+
+	base, err := d.baseQuery()
+	if err != nil {
+		return err
+	}
+
+	rows, err := db.QueryContext(ctx, d.withParams(base, dsq.Query{Prefix: prefix}))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key string
+		var value []byte
+		var id sql.NullString
+
+		dest := []interface{}{&key, &value}
+		if d.keyring != nil {
+			dest = append(dest, &id)
+		}
+
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+
+		if d.keyring != nil {
+			value, err = d.decrypt(ds.RawKey(key), value, id)
+			if err != nil {
+				return err
+			}
+		}
+
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+func (d *Datastore) GetSize(key ds.Key) (size int, err error) {
+	if d.bloom != nil && d.bloom.missing(key) {
+		return -1, ds.ErrNotFound
+	}
+
+	if d.cache != nil {
+		if size, ok := d.cache.getSize(key); ok {
+			return size, nil
+		}
+	}
+
+	err = d.read(func(db *sql.DB) error {
+		size, err = d.getSize(db, key)
+		return err
+	})
+
+	if err == nil && d.cache != nil {
+		d.cache.addSize(key, size)
+	}
+
+	return size, err
+}
+
+func (d *Datastore) getSize(db *sql.DB, key ds.Key) (int, error) {
+	if d.chunks != nil {
+		return d.getSizeChunked(db, key)
+	}
+
+	if d.dedup != nil {
+		return d.getSizeDedup(db, key)
+	}
+
+	if d.keyring != nil {
+		return d.getSizeEncrypted(db, key)
+	}
+
+	row := db.QueryRow(d.queries.GetSize(), key.String())
 	var size int
 
 	switch err := row.Scan(&size); err {
@@ -247,10 +764,43 @@ func (d *Datastore) GetSize(key ds.Key) (int, error) {
 
 // QueryWithParams applies prefix, limit, and offset params in pg query
 func QueryWithParams(d *Datastore, q dsq.Query) (*sql.Rows, error) {
-	var qNew = d.queries.Query()
+	return d.reader().Query(d.withParams(d.queries.Query(), q))
+}
+
+// baseQuery is the statement selecting the entries that RawQuery and scan
+// extend with their suffixes
+func (d *Datastore) baseQuery() (string, error) {
+	switch {
+	case d.chunks != nil:
+		cq, err := d.chunkQueries()
+		if err != nil {
+			return "", err
+		}
+		return cq.QueryChunked(), nil
+	case d.dedup != nil:
+		dq, err := d.dedupQueries()
+		if err != nil {
+			return "", err
+		}
+		return dq.QueryDedup(), nil
+	case d.keyring != nil:
+		eq, err := d.encryptionQueries()
+		if err != nil {
+			return "", err
+		}
+		return eq.QueryEncrypted(), nil
+	default:
+		return d.queries.Query(), nil
+	}
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`, `'`, `''`)
+
+func (d *Datastore) withParams(base string, q dsq.Query) string {
+	var qNew = base
 
 	if q.Prefix != "" {
-		qNew += fmt.Sprintf(d.queries.Prefix(), q.Prefix)
+		qNew += fmt.Sprintf(d.queries.Prefix(), likeEscaper.Replace(q.Prefix))
 	}
 
 	if q.Limit != 0 {
@@ -261,8 +811,7 @@ func QueryWithParams(d *Datastore, q dsq.Query) (*sql.Rows, error) {
 		qNew += fmt.Sprintf(d.queries.Offset(), q.Offset)
 	}
 
-	return d.db.Query(qNew)
-
+	return qNew
 }
 
 var _ ds.Datastore = (*Datastore)(nil)
@@ -0,0 +1,505 @@
+package sqlds
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// EncryptionQueries are the statements needed to store encrypted values
+// alongside the id of the key that wraps them. Rows with a NULL key id hold
+// plaintext; they are only read with WithPlaintextFallback.
+type EncryptionQueries interface {
+	// PutEncrypted inserts key ($1), data ($2) and key id ($3)
+	PutEncrypted() string
+	// GetEncrypted selects data and key id for key ($1)
+	GetEncrypted() string
+	// GetSizeEncrypted selects the stored data length and key id for key ($1)
+	GetSizeEncrypted() string
+	// QueryEncrypted selects key, data and key id, and accepts the Prefix,
+	// Limit and Offset suffixes
+	QueryEncrypted() string
+	// StaleEncrypted selects up to $2 rows of key, data and key id whose key
+	// id is not $1, skipping rows whose data is not stored inline
+	StaleEncrypted() string
+	// UpdateEncrypted replaces data ($2) and key id ($3) for key ($1) if the
+	// row is still wrapped with key id ($4)
+	UpdateEncrypted() string
+}
+
+var (
+	// ErrUnknownKeyID is returned when a row is wrapped with a key that is
+	// not in the keyring
+	ErrUnknownKeyID = errors.New("sqlds: value encrypted with unknown key id")
+
+	// ErrCorruptEnvelope is returned when an encrypted value cannot be
+	// decoded or authenticated
+	ErrCorruptEnvelope = errors.New("sqlds: corrupt encrypted value")
+
+	// ErrPlaintextValue is returned when a row is not encrypted and the
+	// Datastore was not created with WithPlaintextFallback
+	ErrPlaintextValue = errors.New("sqlds: value is not encrypted")
+)
+
+const (
+	envelopeVersion = 1
+	dataKeySize     = 32
+
+	// version | wrap nonce | wrapped data key | data nonce | tag
+	envelopeOverhead = 1 + 12 + (dataKeySize + 16) + 12 + 16
+)
+
+// Keyring holds the key-encryption keys used to wrap per-row data keys.
+// New values are always wrapped with the current key; older keys are kept
+// so existing rows stay readable until they are rotated.
+type Keyring struct {
+	mu      sync.RWMutex
+	keys    map[string]cipher.AEAD
+	current string
+}
+
+// NewKeyring returns a keyring whose current key is kek, identified by id.
+// kek must be 16, 24 or 32 bytes long.
+func NewKeyring(id string, kek []byte) (*Keyring, error) {
+	k := &Keyring{keys: make(map[string]cipher.AEAD)}
+	if err := k.Add(id, kek); err != nil {
+		return nil, err
+	}
+
+	k.current = id
+	return k, nil
+}
+
+// Add makes kek available for unwrapping rows with the given key id
+func (k *Keyring) Add(id string, kek []byte) error {
+	if id == "" {
+		return errors.New("sqlds: key id must not be empty")
+	}
+
+	aead, err := newGCM(kek)
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys[id] = aead
+	return nil
+}
+
+// SetCurrent selects the key used to wrap newly written values
+func (k *Keyring) SetCurrent(id string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if _, ok := k.keys[id]; !ok {
+		return ErrUnknownKeyID
+	}
+
+	k.current = id
+	return nil
+}
+
+// Remove drops a key from the keyring. Rows still wrapped with it become
+// unreadable, so only remove keys after RotateKeys has finished.
+func (k *Keyring) Remove(id string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if id == k.current {
+		return errors.New("sqlds: cannot remove the current key")
+	}
+
+	delete(k.keys, id)
+	return nil
+}
+
+// Current returns the id of the key used for new values
+func (k *Keyring) Current() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.current
+}
+
+func (k *Keyring) get(id string) (cipher.AEAD, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	aead, ok := k.keys[id]
+	if !ok {
+		return nil, ErrUnknownKeyID
+	}
+
+	return aead, nil
+}
+
+func (k *Keyring) seal(key ds.Key, value []byte) ([]byte, string, error) {
+	k.mu.RLock()
+	id := k.current
+	kek := k.keys[id]
+	k.mu.RUnlock()
+
+	dek := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, dek); err != nil {
+		return nil, "", err
+	}
+
+	aead, err := newGCM(dek)
+	if err != nil {
+		return nil, "", err
+	}
+
+	out := make([]byte, 0, len(value)+envelopeOverhead)
+	out = append(out, envelopeVersion)
+	out, err = sealWith(kek, out, dek, []byte(id))
+	if err != nil {
+		return nil, "", err
+	}
+
+	out, err = sealWith(aead, out, value, key.Bytes())
+	if err != nil {
+		return nil, "", err
+	}
+
+	return out, id, nil
+}
+
+func (k *Keyring) open(key ds.Key, data []byte, id string) ([]byte, error) {
+	if len(data) < envelopeOverhead || data[0] != envelopeVersion {
+		return nil, ErrCorruptEnvelope
+	}
+
+	kek, err := k.get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped := data[1 : 1+12+dataKeySize+16]
+	dek, err := kek.Open(nil, wrapped[:12], wrapped[12:], []byte(id))
+	if err != nil {
+		return nil, ErrCorruptEnvelope
+	}
+
+	aead, err := newGCM(dek)
+	if err != nil {
+		return nil, err
+	}
+
+	body := data[len(wrapped)+1:]
+	out, err := aead.Open(nil, body[:12], body[12:], key.Bytes())
+	if err != nil {
+		return nil, ErrCorruptEnvelope
+	}
+
+	return out, nil
+}
+
+// rewrap re-encrypts only the data key of an envelope with the current key,
+// leaving the (possibly large) value ciphertext untouched.
+func (k *Keyring) rewrap(data []byte, id string) ([]byte, string, error) {
+	if len(data) < envelopeOverhead || data[0] != envelopeVersion {
+		return nil, "", ErrCorruptEnvelope
+	}
+
+	old, err := k.get(id)
+	if err != nil {
+		return nil, "", err
+	}
+
+	wrapped := data[1 : 1+12+dataKeySize+16]
+	dek, err := old.Open(nil, wrapped[:12], wrapped[12:], []byte(id))
+	if err != nil {
+		return nil, "", ErrCorruptEnvelope
+	}
+
+	k.mu.RLock()
+	newID := k.current
+	kek := k.keys[newID]
+	k.mu.RUnlock()
+
+	out := make([]byte, 0, len(data))
+	out = append(out, envelopeVersion)
+	out, err = sealWith(kek, out, dek, []byte(newID))
+	if err != nil {
+		return nil, "", err
+	}
+
+	out = append(out, data[len(wrapped)+1:]...)
+	return out, newID, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func sealWith(aead cipher.AEAD, dst, plaintext, ad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	dst = append(dst, nonce...)
+	return aead.Seal(dst, nonce, plaintext, ad), nil
+}
+
+// WithEncryption encrypts values at rest with AES-GCM. Each value gets its
+// own data key, which is wrapped with the keyring's current key; the id of
+// that key is recorded in the row. It cannot be combined with WithChunking,
+// WithDedup or WithVersioning, and the Datastore's Queries must implement
+// EncryptionQueries.
+func WithEncryption(kr *Keyring) Option {
+	return func(d *Datastore) {
+		d.keyring = kr
+	}
+}
+
+// WithPlaintextFallback lets an encrypted Datastore read rows that have no
+// key id as plaintext, and lets RotateKeys encrypt them, so that encryption
+// can be enabled on an existing table. Plaintext rows are not authenticated:
+// anyone who can write to the table can put values there that Get accepts.
+// Drop this option once RotateKeys has encrypted every row.
+func WithPlaintextFallback() Option {
+	return func(d *Datastore) {
+		d.plaintext = true
+	}
+}
+
+func (d *Datastore) encryptionQueries() (EncryptionQueries, error) {
+	if d.invalid != nil {
+		return nil, d.invalid
+	}
+
+	eq, ok := d.queries.(EncryptionQueries)
+	if !ok {
+		return nil, fmt.Errorf("sqlds: %T does not support encryption", d.queries)
+	}
+
+	return eq, nil
+}
+
+func (d *Datastore) putEncrypted(e execer, key ds.Key, value []byte) (sql.Result, error) {
+	eq, err := d.encryptionQueries()
+	if err != nil {
+		return nil, err
+	}
+
+	data, id, err := d.keyring.seal(key, value)
+	if err != nil {
+		return nil, err
+	}
+
+	return e.Exec(eq.PutEncrypted(), key.String(), data, id)
+}
+
+func (d *Datastore) getEncrypted(db *sql.DB, key ds.Key) ([]byte, error) {
+	eq, err := d.encryptionQueries()
+	if err != nil {
+		return nil, err
+	}
+
+	var data []byte
+	var id sql.NullString
+	row := db.QueryRow(eq.GetEncrypted(), key.String())
+
+	switch err := row.Scan(&data, &id); err {
+	case sql.ErrNoRows:
+		return nil, ds.ErrNotFound
+	case nil:
+		return d.decrypt(key, data, id)
+	default:
+		return nil, err
+	}
+}
+
+func (d *Datastore) decrypt(key ds.Key, data []byte, id sql.NullString) ([]byte, error) {
+	if !id.Valid {
+		if !d.plaintext {
+			return nil, ErrPlaintextValue
+		}
+		return data, nil
+	}
+
+	return d.keyring.open(key, data, id.String)
+}
+
+func (d *Datastore) getSizeEncrypted(db *sql.DB, key ds.Key) (int, error) {
+	eq, err := d.encryptionQueries()
+	if err != nil {
+		return 0, err
+	}
+
+	var size int
+	var id sql.NullString
+	row := db.QueryRow(eq.GetSizeEncrypted(), key.String())
+
+	switch err := row.Scan(&size, &id); err {
+	case sql.ErrNoRows:
+		return -1, ds.ErrNotFound
+	case nil:
+		if !id.Valid {
+			if !d.plaintext {
+				return 0, ErrPlaintextValue
+			}
+			return size, nil
+		}
+		return size - envelopeOverhead, nil
+	default:
+		return 0, err
+	}
+}
+
+func (d *Datastore) rawQueryEncrypted(db *sql.DB, q dsq.Query) (dsq.Results, error) {
+	eq, err := d.encryptionQueries()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(d.withParams(eq.QueryEncrypted(), q))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []dsq.Entry
+	defer rows.Close()
+
+	for rows.Next() {
+		var key string
+		var data []byte
+		var id sql.NullString
+		if err := rows.Scan(&key, &data, &id); err != nil {
+			return nil, err
+		}
+
+		out, err := d.decrypt(ds.RawKey(key), data, id)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, dsq.Entry{
+			Key:   key,
+			Value: out,
+		})
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return dsq.ResultsWithEntries(q, entries), nil
+}
+
+// RotateKeys re-wraps every row that is not protected by the keyring's
+// current key, batchSize rows per transaction, so the datastore stays
+// usable while rotation is in progress. Plaintext rows are encrypted with
+// WithPlaintextFallback, and fail rotation with ErrPlaintextValue without
+// it. Chunked and deduplicated rows hold no data of their own and are
+// skipped. It returns the number of rows rewritten.
+func (d *Datastore) RotateKeys(batchSize int) (int, error) {
+	if d.keyring == nil {
+		return 0, errors.New("sqlds: encryption is not enabled")
+	}
+
+	if batchSize <= 0 {
+		return 0, errors.New("sqlds: batch size must be positive")
+	}
+
+	eq, err := d.encryptionQueries()
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0
+	for {
+		n, err := d.rotateBatch(eq, batchSize)
+		total += n
+		if err != nil {
+			return total, err
+		}
+
+		if n == 0 {
+			return total, nil
+		}
+	}
+}
+
+type staleRow struct {
+	key  string
+	data []byte
+	id   sql.NullString
+}
+
+func (d *Datastore) rotateBatch(eq EncryptionQueries, batchSize int) (int, error) {
+	rows, err := d.db.Query(eq.StaleEncrypted(), d.keyring.Current(), batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	var stale []staleRow
+	for rows.Next() {
+		var r staleRow
+		if err := rows.Scan(&r.key, &r.data, &r.id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		stale = append(stale, r)
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	if len(stale) == 0 {
+		return 0, nil
+	}
+
+	txn, err := d.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, r := range stale {
+		var data []byte
+		var id string
+		switch {
+		case r.id.Valid:
+			data, id, err = d.keyring.rewrap(r.data, r.id.String)
+		case d.plaintext:
+			data, id, err = d.keyring.seal(ds.RawKey(r.key), r.data)
+		default:
+			err = ErrPlaintextValue
+		}
+
+		if err != nil {
+			txn.Rollback()
+			return 0, fmt.Errorf("sqlds: rotating %s: %s", r.key, err)
+		}
+
+		// rows changed by a concurrent writer are simply picked up again
+		// by the next batch
+		_, err = txn.Exec(eq.UpdateEncrypted(), r.key, data, id, r.id)
+		if err != nil {
+			txn.Rollback()
+			return 0, err
+		}
+	}
+
+	if err := txn.Commit(); err != nil {
+		return 0, err
+	}
+
+	return len(stale), nil
+}
@@ -0,0 +1,188 @@
+package sqlds_test
+
+import (
+	"bytes"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	sqlds "github.com/whyrusleeping/sql-datastore"
+	"github.com/whyrusleeping/sql-datastore/postgres"
+)
+
+func newTestKeyring(t *testing.T, id string, b byte) *sqlds.Keyring {
+	kr, err := sqlds.NewKeyring(id, bytes.Repeat([]byte{b}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kr
+}
+
+func TestEncryptedPutGet(t *testing.T) {
+	kr := newTestKeyring(t, "k1", 1)
+	d, done := newDS(t, sqlds.WithEncryption(kr))
+	defer done()
+
+	addTestCases(t, d, testcases)
+
+	var raw []byte
+	var id string
+	row := d.DB().QueryRow("SELECT data, key_id FROM blocks WHERE key = $1", "/a/b")
+	if err := row.Scan(&raw, &id); err != nil {
+		t.Fatal(err)
+	}
+
+	if id != "k1" {
+		t.Fatalf("expected key id k1, got %s", id)
+	}
+
+	if bytes.Contains(raw, []byte("ab")) {
+		t.Fatal("value stored in plaintext")
+	}
+
+	size, err := d.GetSize(ds.NewKey("/a/b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != len("ab") {
+		t.Fatalf("incorrect size: expected %d, got %d", len("ab"), size)
+	}
+
+	rs, err := d.Query(dsq.Query{Prefix: "/a/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := rs.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if string(e.Value) != testcases[e.Key] {
+			t.Errorf("%s values differ: %s != %s", e.Key, testcases[e.Key], e.Value)
+		}
+	}
+}
+
+func TestEncryptedRowsAreBoundToKey(t *testing.T) {
+	kr := newTestKeyring(t, "k1", 1)
+	d, done := newDS(t, sqlds.WithEncryption(kr))
+	defer done()
+
+	addTestCases(t, d, testcases)
+
+	_, err := d.DB().Exec("UPDATE blocks SET data = (SELECT data FROM blocks WHERE key = '/e') WHERE key = '/f'")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.Get(ds.NewKey("/f")); err != sqlds.ErrCorruptEnvelope {
+		t.Fatal("expected ErrCorruptEnvelope for swapped row, got: ", err)
+	}
+}
+
+func TestRotateKeys(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	// rows written before encryption was enabled are rotated too
+	if err := d.Put(ds.NewKey("/plain"), []byte("plain")); err != nil {
+		t.Fatal(err)
+	}
+
+	kr := newTestKeyring(t, "k1", 1)
+	d = sqlds.NewDatastore(d.DB(), postgres.Queries{}, sqlds.WithEncryption(kr), sqlds.WithPlaintextFallback())
+	addTestCases(t, d, testcases)
+
+	if err := kr.Add("k2", bytes.Repeat([]byte{2}, 32)); err != nil {
+		t.Fatal(err)
+	}
+	if err := kr.SetCurrent("k2"); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := d.RotateKeys(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(testcases)+1 {
+		t.Fatalf("expected %d rotated rows, got %d", len(testcases)+1, n)
+	}
+
+	if err := kr.Remove("k1"); err != nil {
+		t.Fatal(err)
+	}
+
+	var stale int
+	row := d.DB().QueryRow("SELECT count(*) FROM blocks WHERE key_id IS DISTINCT FROM 'k2'")
+	if err := row.Scan(&stale); err != nil {
+		t.Fatal(err)
+	}
+	if stale != 0 {
+		t.Fatalf("%d rows not rotated", stale)
+	}
+
+	for k, v := range testcases {
+		val, err := d.Get(ds.NewKey(k))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(val) != v {
+			t.Errorf("%s values differ: %s != %s", k, v, val)
+		}
+	}
+
+	val, err := d.Get(ds.NewKey("/plain"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(val) != "plain" {
+		t.Fatal("plaintext row changed by rotation")
+	}
+
+	n, err = d.RotateKeys(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("expected nothing left to rotate, got %d", n)
+	}
+}
+
+func TestEncryptedRefusesPlaintext(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	// a row written without encryption, or slipped into the table
+	if err := d.Put(ds.NewKey("/plain"), []byte("plain")); err != nil {
+		t.Fatal(err)
+	}
+
+	d = sqlds.NewDatastore(d.DB(), postgres.Queries{}, sqlds.WithEncryption(newTestKeyring(t, "k1", 1)))
+	if _, err := d.Get(ds.NewKey("/plain")); err != sqlds.ErrPlaintextValue {
+		t.Fatal("expected ErrPlaintextValue, got", err)
+	}
+	if _, err := d.GetSize(ds.NewKey("/plain")); err != sqlds.ErrPlaintextValue {
+		t.Fatal("expected ErrPlaintextValue, got", err)
+	}
+	if _, err := d.RotateKeys(10); err == nil {
+		t.Fatal("expected rotation to refuse the plaintext row")
+	}
+}
+
+func TestRotateKeysSkipsChunkedRows(t *testing.T) {
+	d, done := newDS(t, sqlds.WithChunking(sqlds.ChunkConfig{Threshold: 10, ChunkSize: 4}))
+	defer done()
+
+	if err := d.Put(ds.NewKey("/large"), bytes.Repeat([]byte("x"), 20)); err != nil {
+		t.Fatal(err)
+	}
+
+	d = sqlds.NewDatastore(d.DB(), postgres.Queries{}, sqlds.WithEncryption(newTestKeyring(t, "k1", 1)), sqlds.WithPlaintextFallback())
+	n, err := d.RotateKeys(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("expected the chunked row to be skipped, rotated %d", n)
+	}
+}
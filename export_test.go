@@ -0,0 +1,25 @@
+package sqlds
+
+import (
+	"database/sql"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// DB returns the primary database, for tests that inspect or damage the
+// tables behind d
+func (d *Datastore) DB() *sql.DB {
+	return d.db
+}
+
+// SetCheckpoint records last as the last key copied by the named
+// migration, for the migration tests
+func (d *Datastore) SetCheckpoint(name string, last ds.Key) error {
+	_, err := d.db.Exec(d.queries.(MigrateQueries).PutCheckpoint(), name, last.String())
+	return err
+}
+
+// RollbackBatch abandons an uncommitted batch
+func RollbackBatch(b ds.Batch) error {
+	return b.(*batch).txn.Rollback()
+}
@@ -0,0 +1,197 @@
+// Package testdb opens the databases the tests run against. By default that
+// is an embedded SQLite database in a temporary directory, so the suite
+// needs no setup. Set SQLDS_TEST_DB=postgres to run against a postgres
+// database named "test_datastore" on localhost instead.
+//
+// The SQLite driver accepts postgres-style $N placeholders, and testdb adds
+// the postgres functions the statements use, so statements written for
+// postgres run unchanged against either backend.
+package testdb
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq" //postgres driver
+	"modernc.org/sqlite"  //pure Go sqlite driver
+)
+
+// Env is the environment variable that selects the backend
+const Env = "SQLDS_TEST_DB"
+
+var postgresSchema = []string{
+	"CREATE TABLE IF NOT EXISTS blocks (namespace TEXT NOT NULL DEFAULT '', key TEXT NOT NULL, data BYTEA, key_id TEXT, content BYTEA, size BIGINT, UNIQUE (namespace, key))",
+	"CREATE TABLE IF NOT EXISTS block_chunks (namespace TEXT NOT NULL DEFAULT '', key TEXT NOT NULL, idx INTEGER NOT NULL, data BYTEA NOT NULL, PRIMARY KEY (namespace, key, idx))",
+	"CREATE TABLE IF NOT EXISTS block_history (seq BIGSERIAL PRIMARY KEY, namespace TEXT NOT NULL DEFAULT '', key TEXT NOT NULL, data BYTEA, deleted BOOLEAN NOT NULL, ts TIMESTAMPTZ NOT NULL)",
+	"CREATE TABLE IF NOT EXISTS block_snapshots (namespace TEXT NOT NULL DEFAULT '', name TEXT NOT NULL, ts TIMESTAMPTZ NOT NULL, PRIMARY KEY (namespace, name))",
+	"CREATE TABLE IF NOT EXISTS block_tombstones (seq BIGSERIAL PRIMARY KEY, namespace TEXT NOT NULL DEFAULT '', key TEXT NOT NULL, data BYTEA, key_id TEXT, deleted_at TIMESTAMPTZ NOT NULL)",
+	"CREATE TABLE IF NOT EXISTS block_contents (namespace TEXT NOT NULL DEFAULT '', hash BYTEA NOT NULL, data BYTEA NOT NULL, refs BIGINT NOT NULL, PRIMARY KEY (namespace, hash))",
+	"CREATE TABLE IF NOT EXISTS block_changes (seq BIGSERIAL PRIMARY KEY, namespace TEXT NOT NULL DEFAULT '', op TEXT NOT NULL, key TEXT NOT NULL, ts TIMESTAMPTZ NOT NULL DEFAULT clock_timestamp())",
+	"CREATE TABLE IF NOT EXISTS block_audit (seq BIGSERIAL PRIMARY KEY, namespace TEXT NOT NULL DEFAULT '', op TEXT NOT NULL, key TEXT NOT NULL, size BIGINT NOT NULL, caller TEXT NOT NULL, ts TIMESTAMPTZ NOT NULL)",
+	"CREATE TABLE IF NOT EXISTS block_migrations (namespace TEXT NOT NULL DEFAULT '', name TEXT NOT NULL, last_key TEXT NOT NULL, PRIMARY KEY (namespace, name))",
+}
+
+// sqliteTime is the format the driver writes times in with
+// _time_format=sqlite; in UTC, such times compare correctly as text
+const sqliteTime = "2006-01-02 15:04:05.999999999-07:00"
+
+// sqliteTimes are the formats times are stored in: sqliteTime, and the
+// UTC format of strftime defaults
+var sqliteTimes = []string{sqliteTime, "2006-01-02 15:04:05.999999999"}
+
+func init() {
+	sqlite.MustRegisterScalarFunction("clock_timestamp", 0, func(*sqlite.FunctionContext, []driver.Value) (driver.Value, error) {
+		return time.Now().UTC().Format(sqliteTime), nil
+	})
+
+	// SQLite runs one writer at a time, so advisory locks have nothing
+	// left to do and whichever key they are given will do
+	sqlite.MustRegisterDeterministicScalarFunction("hashtext", 1, func(*sqlite.FunctionContext, []driver.Value) (driver.Value, error) {
+		return int64(0), nil
+	})
+	for _, name := range []string{"pg_advisory_xact_lock", "pg_advisory_xact_lock_shared"} {
+		sqlite.MustRegisterScalarFunction(name, 1, func(*sqlite.FunctionContext, []driver.Value) (driver.Value, error) {
+			return nil, nil
+		})
+	}
+
+	// date_part only supports the epoch field, to subtract times
+	sqlite.MustRegisterDeterministicScalarFunction("date_part", 2, func(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		if args[0] != "epoch" {
+			return nil, fmt.Errorf("date_part: unsupported field %v", args[0])
+		}
+
+		switch v := args[1].(type) {
+		case nil:
+			return nil, nil
+		case time.Time:
+			return float64(v.UnixNano()) / 1e9, nil
+		case string:
+			for _, layout := range sqliteTimes {
+				if t, err := time.Parse(layout, v); err == nil {
+					return float64(t.UnixNano()) / 1e9, nil
+				}
+			}
+		}
+
+		return nil, fmt.Errorf("date_part: cannot parse time %v", args[1])
+	})
+}
+
+var sqliteSchema = []string{
+	"CREATE TABLE IF NOT EXISTS blocks (namespace TEXT NOT NULL DEFAULT '', key TEXT NOT NULL, data BLOB, key_id TEXT, content BLOB, size INTEGER, UNIQUE (namespace, key))",
+	"CREATE TABLE IF NOT EXISTS block_chunks (namespace TEXT NOT NULL DEFAULT '', key TEXT NOT NULL, idx INTEGER NOT NULL, data BLOB NOT NULL, PRIMARY KEY (namespace, key, idx))",
+	"CREATE TABLE IF NOT EXISTS block_history (seq INTEGER PRIMARY KEY AUTOINCREMENT, namespace TEXT NOT NULL DEFAULT '', key TEXT NOT NULL, data BLOB, deleted BOOLEAN NOT NULL, ts DATETIME NOT NULL)",
+	"CREATE TABLE IF NOT EXISTS block_snapshots (namespace TEXT NOT NULL DEFAULT '', name TEXT NOT NULL, ts DATETIME NOT NULL, PRIMARY KEY (namespace, name))",
+	"CREATE TABLE IF NOT EXISTS block_tombstones (seq INTEGER PRIMARY KEY AUTOINCREMENT, namespace TEXT NOT NULL DEFAULT '', key TEXT NOT NULL, data BLOB, key_id TEXT, deleted_at DATETIME NOT NULL)",
+	"CREATE TABLE IF NOT EXISTS block_contents (namespace TEXT NOT NULL DEFAULT '', hash BLOB NOT NULL, data BLOB NOT NULL, refs INTEGER NOT NULL, PRIMARY KEY (namespace, hash))",
+	"CREATE TABLE IF NOT EXISTS block_changes (seq INTEGER PRIMARY KEY AUTOINCREMENT, namespace TEXT NOT NULL DEFAULT '', op TEXT NOT NULL, key TEXT NOT NULL, ts DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')))",
+	"CREATE TABLE IF NOT EXISTS block_audit (seq INTEGER PRIMARY KEY AUTOINCREMENT, namespace TEXT NOT NULL DEFAULT '', op TEXT NOT NULL, key TEXT NOT NULL, size INTEGER NOT NULL, caller TEXT NOT NULL, ts DATETIME NOT NULL)",
+	"CREATE TABLE IF NOT EXISTS block_migrations (namespace TEXT NOT NULL DEFAULT '', name TEXT NOT NULL, last_key TEXT NOT NULL, PRIMARY KEY (namespace, name))",
+}
+
+// Postgres reports whether the tests run against postgres
+func Postgres() bool {
+	return os.Getenv(Env) == "postgres"
+}
+
+// RequirePostgres skips tests that exercise postgres-only features
+func RequirePostgres(t testing.TB) {
+	if !Postgres() {
+		t.Skipf("needs postgres, set %s=postgres", Env)
+	}
+}
+
+// Open returns a database holding empty blocks and block_changes tables,
+// and a function that drops them again. Databases opened under different
+// names are independent; on postgres they are schemas of test_datastore,
+// with "" meaning the default one.
+func Open(t testing.TB, name string) (*sql.DB, func()) {
+	if Postgres() {
+		return openPostgres(t, name)
+	}
+
+	return openSQLite(t, name)
+}
+
+func openPostgres(t testing.TB, name string) (*sql.DB, func()) {
+	fmtstr := "postgres://%s:%s@%s/%s?sslmode=disable"
+	constr := fmt.Sprintf(fmtstr, "postgres", "", "127.0.0.1", "test_datastore")
+	if name != "" {
+		constr += "&search_path=" + name
+	}
+
+	db, err := sql.Open("postgres", constr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stmts := postgresSchema
+	if name != "" {
+		stmts = append([]string{"CREATE SCHEMA IF NOT EXISTS " + name}, stmts...)
+	}
+	for _, stmt := range stmts {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return db, func() {
+		if name != "" {
+			db.Exec("DROP SCHEMA " + name + " CASCADE")
+		} else {
+			db.Exec("DROP TABLE IF EXISTS blocks")
+			db.Exec("DROP TABLE IF EXISTS block_changes")
+			db.Exec("DROP TABLE IF EXISTS block_contents")
+			db.Exec("DROP TABLE IF EXISTS block_chunks")
+			db.Exec("DROP TABLE IF EXISTS block_history")
+			db.Exec("DROP TABLE IF EXISTS block_snapshots")
+			db.Exec("DROP TABLE IF EXISTS block_tombstones")
+			db.Exec("DROP TABLE IF EXISTS block_audit")
+			db.Exec("DROP TABLE IF EXISTS block_migrations")
+		}
+		db.Close()
+	}
+}
+
+func openSQLite(t testing.TB, name string) (*sql.DB, func()) {
+	dir, err := ioutil.TempDir("", "testing_sqlite_")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if name == "" {
+		name = "test_datastore"
+	}
+
+	// case_sensitive_like makes LIKE behave as on postgres, and the sqlite
+	// time format is one SQLite's own date functions can parse
+	dsn := "file:" + filepath.Join(dir, name+".db") +
+		"?_pragma=busy_timeout(10000)&_pragma=journal_mode(WAL)" +
+		"&_pragma=case_sensitive_like(1)&_time_format=sqlite"
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	for _, stmt := range sqliteSchema {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			os.RemoveAll(dir)
+			t.Fatal(err)
+		}
+	}
+
+	return db, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
@@ -0,0 +1,403 @@
+package sqlds
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// MigrateQueries are the statements needed to keep migration checkpoints
+// apart from the datastore's own rows
+type MigrateQueries interface {
+	// GetCheckpoint selects the last key copied by migration $1
+	GetCheckpoint() string
+	// PutCheckpoint sets the last key copied by migration $1 to $2
+	PutCheckpoint() string
+	// DeleteCheckpoint removes the checkpoint of migration $1
+	DeleteCheckpoint() string
+}
+
+// MigrateConfig configures MigrateFrom
+type MigrateConfig struct {
+	// Prefix is prepended to every source key, e.g. /blocks when copying
+	// the flatfs directory a go-ipfs repo mounts there
+	Prefix ds.Key
+	// BatchSize is the number of entries committed per transaction
+	BatchSize int
+	// Workers is the number of batches read and written concurrently
+	Workers int
+	// CheckpointName names the checkpoint that keeps the last source key
+	// known to be copied, so that an interrupted migration resumes after
+	// it. Checkpoints are kept in a table of their own, not as entries,
+	// and removed once the copy completes.
+	CheckpointName string
+	// Verify compares every source entry with its copy afterwards
+	Verify bool
+	// Progress, if set, is called after every batch and verified entry
+	Progress func(MigrateProgress)
+}
+
+// DefaultMigrateConfig copies with four workers and verifies the result
+var DefaultMigrateConfig = MigrateConfig{
+	Prefix:         ds.NewKey("/"),
+	BatchSize:      1000,
+	Workers:        4,
+	CheckpointName: "migrate",
+	Verify:         true,
+}
+
+// MigrateProgress reports how far MigrateFrom has got
+type MigrateProgress struct {
+	// Copied is the number of entries written in this run
+	Copied int64
+	// Bytes is the total size of their values
+	Bytes int64
+	// Verified is the number of entries compared so far
+	Verified int64
+	// Checkpoint is the source key the migration would resume after
+	Checkpoint ds.Key
+}
+
+// MismatchError is returned by MigrateFrom when verification finds entries
+// that are missing from, or differ in, the destination.
+type MismatchError struct {
+	Count int64
+	// Keys holds the first few mismatched destination keys
+	Keys []ds.Key
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("sqlds: %d entries differ after migration", e.Count)
+}
+
+const maxMismatchKeys = 100
+
+type migrateJob struct {
+	seq  int
+	keys []ds.Key
+}
+
+type migrateResult struct {
+	seq   int
+	last  ds.Key
+	n     int64
+	bytes int64
+	err   error
+}
+
+// MigrateFrom copies every entry of src into d. Source keys are walked in
+// order and copied in batches by several workers; entries that already
+// exist in d are left alone, unless d is versioned and Put replaces them,
+// so an interrupted migration can simply be run again and picks up from
+// its checkpoint. The Datastore's Queries must implement MigrateQueries.
+func (d *Datastore) MigrateFrom(ctx context.Context, src ds.Datastore, cfg MigrateConfig) (MigrateProgress, error) {
+	var p MigrateProgress
+	mq, ok := d.queries.(MigrateQueries)
+	if !ok {
+		return p, fmt.Errorf("sqlds: %T does not support migrations", d.queries)
+	}
+
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = DefaultMigrateConfig.BatchSize
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = DefaultMigrateConfig.Workers
+	}
+	if cfg.CheckpointName == "" {
+		cfg.CheckpointName = DefaultMigrateConfig.CheckpointName
+	}
+
+	report := func() {
+		if cfg.Progress != nil {
+			cfg.Progress(p)
+		}
+	}
+
+	checkpoint, err := d.getCheckpoint(mq, cfg.CheckpointName)
+	if err != nil {
+		return p, err
+	}
+	p.Checkpoint = checkpoint
+
+	if err := d.copyFrom(ctx, mq, src, cfg, &p, report); err != nil {
+		return p, err
+	}
+
+	if _, err := d.db.Exec(mq.DeleteCheckpoint(), cfg.CheckpointName); err != nil {
+		return p, err
+	}
+
+	if !cfg.Verify {
+		return p, nil
+	}
+
+	return p, d.verifyMigration(ctx, src, cfg, &p, report)
+}
+
+func (d *Datastore) copyFrom(ctx context.Context, mq MigrateQueries, src ds.Datastore, cfg MigrateConfig, p *MigrateProgress, report func()) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	q := dsq.Query{KeysOnly: true, Orders: []dsq.Order{dsq.OrderByKey{}}}
+	if p.Checkpoint.String() != "" {
+		q.Filters = []dsq.Filter{dsq.FilterKeyCompare{Op: dsq.GreaterThan, Key: p.Checkpoint.String()}}
+	}
+
+	res, err := src.Query(q)
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+
+	jobs := make(chan migrateJob)
+	results := make(chan migrateResult)
+
+	// the reader hands its error over once it is done, so that it is not
+	// read while the reader may still be writing it
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(jobs)
+
+		var err error
+		defer func() { readErr <- err }()
+
+		seq := 0
+		var keys []ds.Key
+		send := func() bool {
+			select {
+			case jobs <- migrateJob{seq: seq, keys: keys}:
+				seq, keys = seq+1, nil
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		for r := range res.Next() {
+			if r.Error != nil {
+				err = r.Error
+				return
+			}
+
+			keys = append(keys, ds.RawKey(r.Key))
+			if len(keys) == cfg.BatchSize && !send() {
+				return
+			}
+		}
+
+		if len(keys) > 0 {
+			send()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				r := d.copyBatch(src, cfg.Prefix, job)
+				select {
+				case results <- r:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// batches finish out of order; the checkpoint only moves past a batch
+	// once every batch before it has been committed too
+	finished := make(map[int]migrateResult)
+	next := 0
+	var copyErr error
+	for r := range results {
+		if copyErr != nil {
+			continue
+		}
+		if r.err != nil {
+			copyErr = r.err
+			cancel()
+			continue
+		}
+
+		p.Copied += r.n
+		p.Bytes += r.bytes
+		finished[r.seq] = r
+
+		var last ds.Key
+		for {
+			done, ok := finished[next]
+			if !ok {
+				break
+			}
+			delete(finished, next)
+			last = done.last
+			next++
+		}
+
+		if last.String() != "" {
+			if _, err := d.db.Exec(mq.PutCheckpoint(), cfg.CheckpointName, last.String()); err != nil {
+				copyErr = err
+				cancel()
+				continue
+			}
+			p.Checkpoint = last
+		}
+
+		report()
+	}
+
+	// the workers stop once the reader is done or ctx is cancelled, and
+	// so does the reader
+	if err := <-readErr; err != nil && copyErr == nil {
+		copyErr = err
+	}
+	if copyErr != nil {
+		return copyErr
+	}
+
+	return ctx.Err()
+}
+
+func (d *Datastore) copyBatch(src ds.Datastore, prefix ds.Key, job migrateJob) migrateResult {
+	r := migrateResult{seq: job.seq, last: job.keys[len(job.keys)-1]}
+
+	b := &batch{ds: d}
+	for _, key := range job.keys {
+		value, err := src.Get(key)
+		if err == ds.ErrNotFound {
+			// deleted since it was listed
+			continue
+		}
+		if err != nil {
+			r.err = err
+			break
+		}
+
+		if r.err = b.Put(prefix.Child(key), value); r.err != nil {
+			// Put has rolled the transaction back already
+			return r
+		}
+
+		r.n++
+		r.bytes += int64(len(value))
+	}
+
+	if r.err != nil {
+		if b.txn != nil {
+			b.txn.Rollback()
+		}
+		return r
+	}
+
+	if b.txn != nil {
+		r.err = b.Commit()
+	}
+
+	return r
+}
+
+// getCheckpoint reads a checkpoint from the primary. It returns an empty
+// key if there is none.
+func (d *Datastore) getCheckpoint(mq MigrateQueries, name string) (ds.Key, error) {
+	var last string
+	switch err := d.db.QueryRow(mq.GetCheckpoint(), name).Scan(&last); err {
+	case nil:
+		return ds.RawKey(last), nil
+	case sql.ErrNoRows:
+		return ds.Key{}, nil
+	default:
+		return ds.Key{}, err
+	}
+}
+
+func (d *Datastore) verifyMigration(ctx context.Context, src ds.Datastore, cfg MigrateConfig, p *MigrateProgress, report func()) error {
+	res, err := src.Query(dsq.Query{KeysOnly: true})
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+
+	keys := make(chan ds.Key)
+	var mu sync.Mutex
+	var firstErr error
+	mismatch := &MismatchError{}
+	fail := func(err error) {
+		mu.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		mu.Unlock()
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keys {
+				want, err := src.Get(key)
+				if err == ds.ErrNotFound {
+					continue
+				}
+				if err != nil {
+					fail(err)
+					continue
+				}
+
+				dst := cfg.Prefix.Child(key)
+				got, err := d.Get(dst)
+				if err != nil && err != ds.ErrNotFound {
+					fail(err)
+					continue
+				}
+
+				mu.Lock()
+				if err == ds.ErrNotFound || !bytes.Equal(want, got) {
+					mismatch.Count++
+					if len(mismatch.Keys) < maxMismatchKeys {
+						mismatch.Keys = append(mismatch.Keys, dst)
+					}
+				}
+				p.Verified++
+				report()
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for r := range res.Next() {
+		if r.Error != nil {
+			fail(r.Error)
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			fail(err)
+			break
+		}
+
+		keys <- ds.RawKey(r.Key)
+	}
+	close(keys)
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	if mismatch.Count > 0 {
+		return mismatch
+	}
+
+	return nil
+}
@@ -0,0 +1,170 @@
+package sqlds_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	sqlds "github.com/whyrusleeping/sql-datastore"
+)
+
+func newMigrateSource(t *testing.T, n int) ds.Datastore {
+	src := ds.NewMapDatastore()
+	for i := 0; i < n; i++ {
+		k := ds.NewKey(fmt.Sprintf("/k%03d", i))
+		if err := src.Put(k, []byte(fmt.Sprintf("value %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return src
+}
+
+func TestMigrateFrom(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	src := newMigrateSource(t, 100)
+	cfg := sqlds.DefaultMigrateConfig
+	cfg.Prefix = ds.NewKey("/copied")
+	cfg.BatchSize = 7
+	cfg.Workers = 3
+
+	p, err := d.MigrateFrom(context.Background(), src, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Copied != 100 || p.Verified != 100 {
+		t.Fatalf("unexpected progress: %+v", p)
+	}
+	if p.Checkpoint.String() != "/k099" {
+		t.Fatalf("expected checkpoint at the last key, got %s", p.Checkpoint)
+	}
+
+	val, err := d.Get(ds.NewKey("/copied/k042"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(val) != "value 42" {
+		t.Fatalf("wrong value: %s", val)
+	}
+
+	var n int
+	if err := d.DB().QueryRow(`SELECT count(*) FROM block_migrations`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatal("checkpoint should be removed after a complete copy")
+	}
+}
+
+func TestMigrateFromResumes(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	src := newMigrateSource(t, 20)
+	cfg := sqlds.DefaultMigrateConfig
+	cfg.Verify = false
+
+	if err := d.SetCheckpoint(cfg.CheckpointName, ds.NewKey("/k009")); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := d.MigrateFrom(context.Background(), src, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Copied != 10 {
+		t.Fatalf("expected the 10 keys after the checkpoint to be copied, got %d", p.Copied)
+	}
+
+	if _, err := d.Get(ds.NewKey("/k009")); err != ds.ErrNotFound {
+		t.Fatal("keys before the checkpoint should have been skipped, got", err)
+	}
+	if _, err := d.Get(ds.NewKey("/k010")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateFromReportsMismatches(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	src := newMigrateSource(t, 10)
+	if err := d.Put(ds.NewKey("/k003"), []byte("stale")); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := d.MigrateFrom(context.Background(), src, sqlds.DefaultMigrateConfig)
+	merr, ok := err.(*sqlds.MismatchError)
+	if !ok {
+		t.Fatal("expected a MismatchError, got", err)
+	}
+	if merr.Count != 1 || !merr.Keys[0].Equal(ds.NewKey("/k003")) {
+		t.Fatalf("unexpected mismatches: %+v", merr)
+	}
+}
+
+func TestMigrateCheckpointLeavesNoTrail(t *testing.T) {
+	d, done := newDS(t,
+		sqlds.WithVersioning(sqlds.VersionConfig{}),
+		sqlds.WithSoftDelete(sqlds.SoftDeleteConfig{}),
+		sqlds.WithAudit(sqlds.AuditConfig{}),
+	)
+	defer done()
+
+	src := newMigrateSource(t, 20)
+	cfg := sqlds.DefaultMigrateConfig
+	cfg.BatchSize = 3
+	cfg.Workers = 1
+	cfg.Verify = false
+
+	if err := d.SetCheckpoint(cfg.CheckpointName, ds.NewKey("/k001")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.MigrateFrom(context.Background(), src, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	// only the copied keys, and batch commits, which have none, are recorded
+	for _, table := range []string{"block_history", "block_tombstones", "block_audit"} {
+		var n int
+		err := d.DB().QueryRow(`SELECT count(*) FROM ` + table + ` WHERE key NOT LIKE '/k%' AND key <> ''`).Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 0 {
+			t.Fatalf("checkpoint left %d rows in %s", n, table)
+		}
+	}
+}
+
+func TestMigrateCheckpointIsNotAnEntry(t *testing.T) {
+	d, done := newDS(t, sqlds.WithEncryption(newTestKeyring(t, "k1", 1)))
+	defer done()
+
+	src := newMigrateSource(t, 20)
+	cfg := sqlds.DefaultMigrateConfig
+	cfg.Verify = false
+
+	if err := d.SetCheckpoint(cfg.CheckpointName, ds.NewKey("/k009")); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := d.Query(dsq.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("checkpoint listed as entries %v", entries)
+	}
+
+	if _, err := d.MigrateFrom(context.Background(), src, cfg); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,71 @@
+package sqlds
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// NamespaceQueries are implemented by dialects whose tables can be shared
+// by several tenants, each confined to the rows of its own namespace.
+type NamespaceQueries interface {
+	// InNamespace returns queries that only read and write the rows of ns.
+	// The empty namespace holds the rows written without one; it does not
+	// see the rows of other namespaces.
+	InNamespace(ns string) Queries
+}
+
+// DiskUsageQueries are the statements needed to report DiskUsage
+type DiskUsageQueries interface {
+	// DiskUsage selects the total size of all keys and values
+	DiskUsage() string
+}
+
+// NewNamespacedDatastore returns a datastore that only sees the keys of
+// namespace ns, so that a Query with an empty prefix lists just that
+// tenant's keys. Namespaces share the change log sequence, so the
+// sequence numbers of a tenant's changes are not contiguous.
+func NewNamespacedDatastore(db *sql.DB, queries Queries, ns string, opts ...Option) (*Datastore, error) {
+	nq, ok := queries.(NamespaceQueries)
+	if !ok {
+		return nil, fmt.Errorf("sqlds: %T does not support namespaces", queries)
+	}
+	if ns == "" {
+		return nil, errors.New("sqlds: empty namespace")
+	}
+
+	return NewDatastore(db, nq.InNamespace(ns), opts...), nil
+}
+
+// DiskUsage returns the size of the keys and values in the datastore's
+// namespace
+func (d *Datastore) DiskUsage() (uint64, error) {
+	var query string
+	if d.dedup != nil {
+		dq, err := d.dedupQueries()
+		if err != nil {
+			return 0, err
+		}
+		query = dq.DiskUsageDedup()
+	} else {
+		uq, ok := d.queries.(DiskUsageQueries)
+		if !ok {
+			return 0, fmt.Errorf("sqlds: %T does not support disk usage", d.queries)
+		}
+		query = uq.DiskUsage()
+	}
+
+	var usage int64
+	err := d.read(func(db *sql.DB) error {
+		return db.QueryRow(query).Scan(&usage)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return uint64(usage), nil
+}
+
+var _ ds.PersistentDatastore = (*Datastore)(nil)
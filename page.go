@@ -0,0 +1,58 @@
+package sqlds
+
+import (
+	"fmt"
+	"strings"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// PageQueries are the statements needed to read keys in key order, one
+// page at a time
+type PageQueries interface {
+	// KeysAfter selects up to $3 keys that sort after $1 and match the LIKE
+	// pattern $2 (escaped with '\'), in key order
+	KeysAfter() string
+}
+
+// likeParam escapes a prefix for use in a LIKE pattern bound as a parameter
+var likeParam = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// KeysAfter returns up to limit keys below prefix that sort after after,
+// in key order. Passing the last key of a page as after returns the next
+// page, so a table can be walked without holding it in memory or keeping
+// a query open. Keys are read from the primary. The Datastore's Queries
+// must implement PageQueries.
+func (d *Datastore) KeysAfter(prefix string, after ds.Key, limit int) ([]ds.Key, error) {
+	pq, ok := d.queries.(PageQueries)
+	if !ok {
+		return nil, fmt.Errorf("sqlds: %T does not support paging", d.queries)
+	}
+
+	var keys []ds.Key
+	err := d.retry(func() error {
+		return d.guard(func() error {
+			keys = keys[:0]
+			rows, err := d.db.Query(pq.KeysAfter(), after.String(), likeParam.Replace(prefix)+"%", limit)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+
+			for rows.Next() {
+				var key string
+				if err := rows.Scan(&key); err != nil {
+					return err
+				}
+				keys = append(keys, ds.RawKey(key))
+			}
+
+			return rows.Err()
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
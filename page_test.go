@@ -0,0 +1,47 @@
+package sqlds_test
+
+import (
+	"fmt"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+func TestKeysAfter(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	for i := 0; i < 10; i++ {
+		if err := d.Put(ds.NewKey(fmt.Sprintf("/page/%02d", i)), []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Put(ds.NewKey("/page_other"), []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	var after ds.Key
+	for {
+		keys, err := d.KeysAfter("/page/", after, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) == 0 {
+			break
+		}
+		for _, k := range keys {
+			got = append(got, k.String())
+		}
+		after = keys[len(keys)-1]
+	}
+
+	if len(got) != 10 {
+		t.Fatalf("expected 10 keys, got %v", got)
+	}
+	for i, k := range got {
+		if k != fmt.Sprintf("/page/%02d", i) {
+			t.Fatalf("key %d out of order: %v", i, got)
+		}
+	}
+}
@@ -0,0 +1,10 @@
+module github.com/whyrusleeping/sql-datastore/plugin
+
+go 1.26.0
+
+require (
+	github.com/ipfs/go-ipfs v0.4.21
+	github.com/whyrusleeping/sql-datastore v0.0.0-00010101000000-000000000000
+)
+
+replace github.com/whyrusleeping/sql-datastore => ../
@@ -0,0 +1,110 @@
+// Package plugin registers sqlds as a go-ipfs datastore. Build it into
+// go-ipfs (or load it as a plugin) and use a spec such as
+//
+//	{
+//		"type": "sqlds",
+//		"host": "127.0.0.1",
+//		"port": "5432",
+//		"user": "postgres",
+//		"password": "secret",
+//		"database": "ipfs",
+//		"namespace": "node1"
+//	}
+//
+// in the repo config's Datastore.Spec. With a namespace, several nodes can
+// keep their repos in the same database.
+package plugin
+
+import (
+	"fmt"
+
+	"github.com/ipfs/go-ipfs/plugin"
+	"github.com/ipfs/go-ipfs/repo"
+	"github.com/ipfs/go-ipfs/repo/fsrepo"
+
+	"github.com/whyrusleeping/sql-datastore/postgres"
+)
+
+// Plugins is exported list of plugins that will be loaded
+var Plugins = []plugin.Plugin{
+	&sqldsPlugin{},
+}
+
+type sqldsPlugin struct{}
+
+var _ plugin.PluginDatastore = (*sqldsPlugin)(nil)
+
+func (*sqldsPlugin) Name() string {
+	return "ds-sqlds"
+}
+
+func (*sqldsPlugin) Version() string {
+	return "0.1.0"
+}
+
+func (*sqldsPlugin) Init() error {
+	return nil
+}
+
+func (*sqldsPlugin) DatastoreTypeName() string {
+	return "sqlds"
+}
+
+type datastoreConfig struct {
+	opts postgres.Options
+}
+
+// DatastoreConfigParser parses the connection options of a sqlds spec.
+// Every field is optional and defaults as in postgres.Options.
+func (*sqldsPlugin) DatastoreConfigParser() fsrepo.ConfigFromMap {
+	return func(params map[string]interface{}) (fsrepo.DatastoreConfig, error) {
+		var c datastoreConfig
+		fields := map[string]*string{
+			"host":      &c.opts.Host,
+			"port":      &c.opts.Port,
+			"user":      &c.opts.User,
+			"password":  &c.opts.Password,
+			"database":  &c.opts.Database,
+			"namespace": &c.opts.Namespace,
+		}
+
+		for name, dst := range fields {
+			v, ok := params[name]
+			if !ok {
+				continue
+			}
+
+			switch v := v.(type) {
+			case string:
+				*dst = v
+			case float64:
+				// JSON numbers, e.g. an unquoted port
+				*dst = fmt.Sprint(v)
+			default:
+				return nil, fmt.Errorf("'%s' field is not a string", name)
+			}
+		}
+
+		return &c, nil
+	}
+}
+
+// DiskSpec identifies the database the repo lives in. Credentials are not
+// part of it so that they can be changed without the repo looking like a
+// different one.
+func (c *datastoreConfig) DiskSpec() fsrepo.DiskSpec {
+	opts := c.opts.WithDefaults()
+
+	return map[string]interface{}{
+		"type":      "sqlds",
+		"host":      opts.Host,
+		"port":      opts.Port,
+		"database":  opts.Database,
+		"namespace": opts.Namespace,
+	}
+}
+
+func (c *datastoreConfig) Create(path string) (repo.Datastore, error) {
+	opts := c.opts
+	return opts.Create()
+}
@@ -0,0 +1,45 @@
+package plugin
+
+import (
+	"testing"
+)
+
+func TestDatastoreConfigParser(t *testing.T) {
+	parse := (&sqldsPlugin{}).DatastoreConfigParser()
+
+	c, err := parse(map[string]interface{}{
+		"type":     "sqlds",
+		"host":     "db.local",
+		"port":     float64(5433),
+		"user":     "ipfs",
+		"password": "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spec := c.DiskSpec()
+	if spec["host"] != "db.local" || spec["port"] != "5433" || spec["database"] != "datastore" {
+		t.Fatalf("unexpected disk spec: %v", spec)
+	}
+	if _, ok := spec["password"]; ok {
+		t.Fatal("credentials must not be part of the disk spec")
+	}
+
+	explicit, err := parse(map[string]interface{}{
+		"type":     "sqlds",
+		"host":     "db.local",
+		"port":     "5433",
+		"database": "datastore",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if explicit.DiskSpec()["port"] != spec["port"] || explicit.DiskSpec()["database"] != spec["database"] {
+		t.Fatal("spelling out defaults changed the disk spec")
+	}
+
+	if _, err := parse(map[string]interface{}{"port": true}); err == nil {
+		t.Fatal("expected an error for a non-string port")
+	}
+}
@@ -0,0 +1,34 @@
+package postgres
+
+import (
+	"github.com/lib/pq"
+	"github.com/whyrusleeping/sql-datastore"
+)
+
+// IsTransient classifies lib/pq errors by SQLSTATE, treating connection
+// exceptions, serialization failures, deadlocks and server shutdowns as
+// retryable. Other errors are passed to sqlds.IsTransient.
+func IsTransient(err error) bool {
+	switch e := err.(type) {
+	case *pq.Error:
+		return sqlds.TransientSQLState(string(e.Code))
+	case pq.Error:
+		return sqlds.TransientSQLState(string(e.Code))
+	default:
+		return sqlds.IsTransient(err)
+	}
+}
+
+// IsConnectionError classifies lib/pq errors by SQLSTATE for the circuit
+// breaker, counting connection exceptions and server shutdowns as failures
+// to reach postgres. Other errors are passed to sqlds.IsConnectionError.
+func IsConnectionError(err error) bool {
+	switch e := err.(type) {
+	case *pq.Error:
+		return sqlds.ConnectionSQLState(string(e.Code))
+	case pq.Error:
+		return sqlds.ConnectionSQLState(string(e.Code))
+	default:
+		return sqlds.IsConnectionError(err)
+	}
+}
@@ -0,0 +1,45 @@
+package postgres
+
+import (
+	"database/sql/driver"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func TestIsTransient(t *testing.T) {
+	for code, transient := range map[pq.ErrorCode]bool{
+		"40001": true,
+		"40P01": true,
+		"08006": true,
+		"57P01": true,
+		"23505": false,
+		"42P01": false,
+	} {
+		if IsTransient(&pq.Error{Code: code}) != transient {
+			t.Errorf("IsTransient(%s) != %v", code, transient)
+		}
+	}
+
+	if !IsTransient(driver.ErrBadConn) {
+		t.Error("bad connections should be transient")
+	}
+}
+
+func TestIsConnectionError(t *testing.T) {
+	for code, failure := range map[pq.ErrorCode]bool{
+		"08006": true,
+		"08001": true,
+		"57P01": true,
+		"40001": false,
+		"23505": false,
+	} {
+		if IsConnectionError(&pq.Error{Code: code}) != failure {
+			t.Errorf("IsConnectionError(%s) != %v", code, failure)
+		}
+	}
+
+	if !IsConnectionError(driver.ErrBadConn) {
+		t.Error("bad connections should be connection errors")
+	}
+}
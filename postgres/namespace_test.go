@@ -0,0 +1,193 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+
+	"github.com/whyrusleeping/sql-datastore"
+	"github.com/whyrusleeping/sql-datastore/internal/testdb"
+)
+
+func TestNamespaces(t *testing.T) {
+	db, done := testdb.Open(t, "")
+	defer done()
+
+	a, err := sqlds.NewNamespacedDatastore(db, Queries{}, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := sqlds.NewNamespacedDatastore(db, Queries{}, "it's b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shared := ds.NewKey("/shared")
+	if err := a.Put(shared, []byte("from a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put(shared, []byte("from b, longer")); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Put(ds.NewKey("/only-a"), []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+
+	val, err := b.Get(shared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(val) != "from b, longer" {
+		t.Fatalf("namespace b read %q", val)
+	}
+
+	if has, err := b.Has(ds.NewKey("/only-a")); err != nil || has {
+		t.Fatal("namespace b sees a's key", err)
+	}
+
+	res, err := b.Query(dsq.Query{KeysOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Key != "/shared" {
+		t.Fatalf("namespace b listed %v", entries)
+	}
+
+	usageA, err := a.DiskUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := uint64(len("/shared") + len("from a") + len("/only-a") + len("x")); usageA != want {
+		t.Fatalf("expected namespace a to use %d bytes, got %d", want, usageA)
+	}
+
+	if err := b.Delete(shared); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Get(shared); err != nil {
+		t.Fatal("delete in namespace b removed a's key:", err)
+	}
+
+	empty := sqlds.NewDatastore(db, Queries{})
+	if _, err := empty.Get(shared); err != ds.ErrNotFound {
+		t.Fatal("the empty namespace sees a's key:", err)
+	}
+	if err := empty.Delete(shared); err != ds.ErrNotFound {
+		t.Fatal("expected the empty namespace to have nothing to delete, got", err)
+	}
+	if _, err := a.Get(shared); err != nil {
+		t.Fatal("delete in the empty namespace removed a's key:", err)
+	}
+	usage, err := empty.DiskUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage != 0 {
+		t.Fatalf("expected the empty namespace to use nothing, got %d", usage)
+	}
+
+	if _, err := sqlds.NewNamespacedDatastore(db, Queries{}, ""); err == nil {
+		t.Fatal("expected an error for the empty namespace")
+	}
+}
+
+func TestNamespacedDedup(t *testing.T) {
+	db, done := testdb.Open(t, "")
+	defer done()
+
+	cfg := sqlds.DedupConfig{}
+	a, err := sqlds.NewNamespacedDatastore(db, Queries{}, "a", sqlds.WithDedup(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := sqlds.NewNamespacedDatastore(db, Queries{}, "b", sqlds.WithDedup(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value := []byte("same content in both namespaces")
+	if err := a.Put(ds.NewKey("/x"), value); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put(ds.NewKey("/y"), value); err != nil {
+		t.Fatal(err)
+	}
+
+	var n int
+	if err := db.QueryRow("SELECT count(*) FROM block_contents").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("expected each namespace to keep its own copy, got %d rows", n)
+	}
+
+	if err := a.Delete(ds.NewKey("/x")); err != nil {
+		t.Fatal(err)
+	}
+	if removed, err := a.CleanupOrphans(); err != nil || removed != 1 {
+		t.Fatalf("expected a's copy to be cleaned up, got %d: %v", removed, err)
+	}
+
+	val, err := b.Get(ds.NewKey("/y"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(val) != string(value) {
+		t.Fatalf("namespace b read %q", val)
+	}
+}
+
+func TestNamespacedChangeLog(t *testing.T) {
+	db, done := testdb.Open(t, "")
+	defer done()
+
+	// a long settle time would stall on any sequence number taken to be
+	// an uncommitted write
+	cfg := sqlds.ChangeLogConfig{SettleTime: time.Hour, PageSize: 2}
+	a, err := sqlds.NewNamespacedDatastore(db, Queries{}, "a", sqlds.WithChangeLog(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := sqlds.NewNamespacedDatastore(db, Queries{}, "b", sqlds.WithChangeLog(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, d := range []*sqlds.Datastore{a, b, b, b, a} {
+		if err := d.Put(ds.NewKey(fmt.Sprintf("/k%d", i)), []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	it, err := a.Changes(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	for {
+		c, ok := it.Next()
+		if !ok {
+			break
+		}
+		if c.Time.IsZero() {
+			t.Fatalf("change %d has no time", c.Seq)
+		}
+		keys = append(keys, c.Key.String())
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(keys) != 2 || keys[0] != "/k0" || keys[1] != "/k4" {
+		t.Fatalf("namespace a read changes %v", keys)
+	}
+}
@@ -3,6 +3,8 @@ package postgres
 import (
 	"database/sql"
 	"fmt"
+	"net/url"
+	"strings"
 
 	"github.com/whyrusleeping/sql-datastore"
 
@@ -16,33 +18,93 @@ type Options struct {
 	User     string
 	Password string
 	Database string
+
+	// Namespace, when set, confines the datastore to its own keys in a
+	// table shared with other namespaces
+	Namespace string
+
+	// Replicas are read-only standbys that serve Get, Has, GetSize and
+	// Query. Empty fields are inherited from the primary.
+	Replicas []Options
+	// ReplicaPolicy selects how reads are spread across Replicas
+	ReplicaPolicy sqlds.ReplicaPolicy
+	// PrimaryFallback retries reads that miss on a replica against the
+	// primary, to cover replication lag
+	PrimaryFallback bool
+
+	// Retry, when MaxAttempts is set, retries idempotent operations that
+	// fail with a transient error. IsTransient is used as the classifier
+	// unless the policy has its own.
+	Retry sqlds.RetryPolicy
+
+	// Breaker, when set, fails operations fast while postgres is down.
+	// IsConnectionError is used as the classifier unless it sets one.
+	Breaker *sqlds.BreakerConfig
 }
 
+// Queries are the postgres statements. Every statement is scoped to the
+// rows of Namespace, so that many datastores can share one table; the
+// zero value uses the empty namespace, which is a namespace like any
+// other.
 type Queries struct {
+	Namespace string
+}
+
+func quote(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
 }
 
-func (Queries) Delete() string {
-	return `DELETE FROM blocks WHERE key = $1`
+// in is the namespace condition on column col
+func (q Queries) in(col string) string {
+	return col + " = " + quote(q.Namespace)
 }
 
-func (Queries) Exists() string {
-	return `SELECT exists(SELECT 1 FROM blocks WHERE key=$1)`
+// and is the namespace condition, to be followed by further conditions
+func (q Queries) and() string {
+	return q.in("namespace") + " AND "
 }
 
-func (Queries) Get() string {
-	return `SELECT data FROM blocks WHERE key = $1`
+// where is the namespace condition as a whole WHERE clause
+func (q Queries) where() string {
+	return " WHERE " + q.in("namespace")
 }
 
-func (Queries) Put() string {
-	return `INSERT INTO blocks (key, data) SELECT $1, $2 WHERE NOT EXISTS ( SELECT key FROM blocks WHERE key = $1)`
+// column and value prefix the column and value lists of an INSERT
+func (q Queries) column() string {
+	return "namespace, "
 }
 
-func (Queries) Query() string {
-	return `SELECT key, data FROM blocks`
+func (q Queries) value() string {
+	return quote(q.Namespace) + ", "
+}
+
+// InNamespace returns the queries scoped to ns
+func (Queries) InNamespace(ns string) sqlds.Queries {
+	return Queries{Namespace: ns}
+}
+
+func (q Queries) Delete() string {
+	return `DELETE FROM blocks WHERE ` + q.and() + `key = $1`
+}
+
+func (q Queries) Exists() string {
+	return `SELECT exists(SELECT 1 FROM blocks WHERE ` + q.and() + `key=$1)`
+}
+
+func (q Queries) Get() string {
+	return `SELECT data FROM blocks WHERE ` + q.and() + `key = $1`
+}
+
+func (q Queries) Put() string {
+	return `INSERT INTO blocks (` + q.column() + `key, data) SELECT ` + q.value() + `$1, $2 WHERE NOT EXISTS ( SELECT key FROM blocks WHERE ` + q.and() + `key = $1)`
+}
+
+func (q Queries) Query() string {
+	return `SELECT key, data FROM blocks` + q.where()
 }
 
 func (Queries) Prefix() string {
-	return ` WHERE key LIKE '%s%%' ORDER BY key`
+	return ` AND key LIKE '%s%%' ESCAPE '\' ORDER BY key`
 }
 
 func (Queries) Limit() string {
@@ -53,21 +115,336 @@ func (Queries) Offset() string {
 	return ` OFFSET %d`
 }
 
-func (Queries) GetSize() string {
-	return `SELECT octet_length(data) FROM blocks WHERE key = $1`
+func (q Queries) GetSize() string {
+	return `SELECT octet_length(data) FROM blocks WHERE ` + q.and() + `key = $1`
+}
+
+func (q Queries) DiskUsage() string {
+	return `SELECT coalesce(sum(octet_length(key) + coalesce(octet_length(data), size, 0)), 0) FROM blocks` + q.where()
+}
+
+func (q Queries) PutChunked() string {
+	return `INSERT INTO blocks (` + q.column() + `key, size) SELECT ` + q.value() + `$1, $2 WHERE NOT EXISTS ( SELECT key FROM blocks WHERE ` + q.and() + `key = $1)`
+}
+
+func (q Queries) PutChunk() string {
+	return `INSERT INTO block_chunks (` + q.column() + `key, idx, data) VALUES (` + q.value() + `$1, $2, $3)`
+}
+
+func (q Queries) GetChunked() string {
+	return `SELECT data, size FROM blocks WHERE ` + q.and() + `key = $1`
+}
+
+func (q Queries) GetSizeChunked() string {
+	return `SELECT coalesce(octet_length(data), size) FROM blocks WHERE ` + q.and() + `key = $1`
+}
+
+func (q Queries) QueryChunked() string {
+	return `SELECT key, data, size FROM blocks` + q.where()
+}
+
+func (q Queries) GetChunks() string {
+	return `SELECT data FROM block_chunks WHERE ` + q.and() + `key = $1 ORDER BY idx`
+}
+
+func (q Queries) DeleteChunks() string {
+	return `DELETE FROM block_chunks WHERE ` + q.and() + `key = $1`
+}
+
+func (q Queries) SetChunkedSize() string {
+	return `UPDATE blocks SET size = $2 WHERE ` + q.and() + `key = $1`
+}
+
+func (q Queries) PutDedup() string {
+	return `INSERT INTO blocks (` + q.column() + `key, content) SELECT ` + q.value() + `$1, $2 WHERE NOT EXISTS ( SELECT key FROM blocks WHERE ` + q.and() + `key = $1)`
+}
+
+func (q Queries) AddRef() string {
+	return `INSERT INTO block_contents (` + q.column() + `hash, data, refs) VALUES (` + q.value() + `$1, $2, 1) ON CONFLICT (namespace, hash) DO UPDATE SET refs = block_contents.refs + 1`
+}
+
+func (q Queries) DeleteDedup() string {
+	return `DELETE FROM blocks WHERE ` + q.and() + `key = $1 RETURNING content`
+}
+
+func (q Queries) Release() string {
+	return `UPDATE block_contents SET refs = refs - 1 WHERE ` + q.and() + `hash = $1`
+}
+
+func (q Queries) GetDedup() string {
+	return `SELECT coalesce(c.data, b.data) FROM blocks b LEFT JOIN block_contents c ON c.namespace = b.namespace AND c.hash = b.content WHERE ` + q.in("b.namespace") + ` AND key = $1`
+}
+
+func (q Queries) GetSizeDedup() string {
+	return `SELECT octet_length(coalesce(c.data, b.data)) FROM blocks b LEFT JOIN block_contents c ON c.namespace = b.namespace AND c.hash = b.content WHERE ` + q.in("b.namespace") + ` AND key = $1`
+}
+
+func (q Queries) QueryDedup() string {
+	return `SELECT key, coalesce(c.data, b.data) FROM blocks b LEFT JOIN block_contents c ON c.namespace = b.namespace AND c.hash = b.content WHERE ` + q.in("b.namespace")
+}
+
+func (q Queries) DiskUsageDedup() string {
+	return `SELECT coalesce(sum(octet_length(key) + octet_length(coalesce(c.data, b.data))), 0) FROM blocks b LEFT JOIN block_contents c ON c.namespace = b.namespace AND c.hash = b.content WHERE ` + q.in("b.namespace")
+}
+
+func (q Queries) DeleteOrphans() string {
+	return `DELETE FROM block_contents WHERE ` + q.and() + `refs <= 0`
+}
+
+func (q Queries) RecordVersion() string {
+	return `INSERT INTO block_history (` + q.column() + `key, data, deleted, ts) VALUES (` + q.value() + `$1, $2, $3, clock_timestamp())`
+}
+
+func (q Queries) VersionAt() string {
+	return `SELECT data, deleted FROM block_history WHERE ` + q.and() + `key = $1 AND ts <= $2 ORDER BY ts DESC, seq DESC LIMIT 1`
+}
+
+func (q Queries) Versions() string {
+	return `SELECT data, deleted, ts FROM block_history WHERE ` + q.and() + `key = $1 ORDER BY ts, seq`
+}
+
+func (q Queries) PruneVersions() string {
+	return `DELETE FROM block_history AS h WHERE ` + q.and() + `ts < $1 AND (deleted OR EXISTS (SELECT 1 FROM block_history AS n WHERE n.namespace = h.namespace AND n.key = h.key AND n.ts < $1 AND (n.ts > h.ts OR (n.ts = h.ts AND n.seq > h.seq))))`
+}
+
+func (q Queries) SeedVersions() string {
+	return `INSERT INTO block_history (namespace, key, data, deleted, ts) SELECT b.namespace, b.key, coalesce(c.data, b.data), false, $1 FROM blocks AS b LEFT JOIN block_contents AS c ON c.namespace = b.namespace AND c.hash = b.content WHERE ` + q.in("b.namespace") + ` AND NOT EXISTS (SELECT 1 FROM block_history AS h WHERE h.namespace = b.namespace AND h.key = b.key)`
+}
+
+func (q Queries) SeedVersion() string {
+	return `INSERT INTO block_history (namespace, key, data, deleted, ts) SELECT b.namespace, b.key, coalesce(c.data, b.data), false, $2 FROM blocks AS b LEFT JOIN block_contents AS c ON c.namespace = b.namespace AND c.hash = b.content WHERE ` + q.in("b.namespace") + ` AND b.key = $1 AND NOT EXISTS (SELECT 1 FROM block_history AS h WHERE h.namespace = b.namespace AND h.key = b.key)`
+}
+
+// historyLock is the advisory lock versioned writes share and snapshots
+// take exclusively
+func (q Queries) historyLock() string {
+	return `hashtext(` + quote("block_history/"+q.Namespace) + `)`
+}
+
+func (q Queries) ShareHistory() string {
+	return `SELECT pg_advisory_xact_lock_shared(` + q.historyLock() + `)`
+}
+
+func (q Queries) LockHistory() string {
+	return `SELECT pg_advisory_xact_lock(` + q.historyLock() + `)`
+}
+
+func (q Queries) CreateSnapshot() string {
+	return `INSERT INTO block_snapshots (` + q.column() + `name, ts) VALUES (` + q.value() + `$1, clock_timestamp())`
+}
+
+func (q Queries) SnapshotTime() string {
+	return `SELECT ts FROM block_snapshots WHERE ` + q.and() + `name = $1`
+}
+
+func (q Queries) ListSnapshots() string {
+	return `SELECT name, ts FROM block_snapshots` + q.where() + ` ORDER BY ts`
+}
+
+func (q Queries) DeleteSnapshot() string {
+	return `DELETE FROM block_snapshots WHERE ` + q.and() + `name = $1`
+}
+
+func (Queries) OldestSnapshot() string {
+	return `SELECT ts FROM block_snapshots ORDER BY ts LIMIT 1`
+}
+
+func (q Queries) QueryAt() string {
+	return `SELECT key, data FROM (SELECT h.namespace, h.key, h.data FROM block_history AS h WHERE NOT h.deleted AND h.ts <= $1 AND NOT EXISTS (SELECT 1 FROM block_history AS n WHERE n.namespace = h.namespace AND n.key = h.key AND n.ts <= $1 AND (n.ts > h.ts OR (n.ts = h.ts AND n.seq > h.seq)))) AS s` + q.where()
+}
+
+func (q Queries) Tombstone() string {
+	return `INSERT INTO block_tombstones (namespace, key, data, key_id, deleted_at) SELECT namespace, key, data, key_id, clock_timestamp() FROM blocks WHERE ` + q.and() + `key = $1`
+}
+
+func (q Queries) LatestTombstone() string {
+	return `SELECT seq, data FROM block_tombstones WHERE ` + q.and() + `key = $1 ORDER BY seq DESC LIMIT 1`
+}
+
+func (q Queries) Undelete() string {
+	return `INSERT INTO blocks (namespace, key, data, key_id) SELECT namespace, key, data, key_id FROM block_tombstones WHERE seq = $2 AND NOT EXISTS ( SELECT key FROM blocks WHERE ` + q.and() + `key = $1)`
+}
+
+func (Queries) DropTombstone() string {
+	return `DELETE FROM block_tombstones WHERE seq = $1`
+}
+
+func (q Queries) PurgeTombstones() string {
+	return `DELETE FROM block_tombstones WHERE ` + q.and() + `deleted_at < $1`
+}
+
+func (q Queries) RecordAudit() string {
+	return `INSERT INTO block_audit (` + q.column() + `op, key, size, caller, ts) VALUES (` + q.value() + `$1, $2, $3, $4, $5)`
+}
+
+func (q Queries) LogChange() string {
+	return `INSERT INTO block_changes (` + q.column() + `op, key) VALUES (` + q.value() + `$1, $2)`
+}
+
+func (q Queries) ChangesSince() string {
+	// changes of other namespaces are joined to nothing, so only their
+	// sequence numbers are read
+	return `SELECT c.seq, m.op, m.key, m.ts, date_part('epoch', clock_timestamp()) - date_part('epoch', c.ts) >= $3 FROM block_changes AS c LEFT JOIN block_changes AS m ON m.seq = c.seq AND m.` + q.in("namespace") + ` WHERE c.seq > $1 ORDER BY c.seq LIMIT $2`
+}
+
+func (q Queries) OldestChange() string {
+	return `SELECT min(seq) FROM block_changes` + q.where()
+}
+
+func (q Queries) NewestChange() string {
+	return `SELECT max(seq) FROM block_changes` + q.where()
+}
+
+func (q Queries) CompactChanges() string {
+	return `DELETE FROM block_changes WHERE ` + q.and() + `ts < $1 AND seq < (SELECT max(seq) FROM block_changes` + q.where() + `)`
+}
+
+func (q Queries) Keys() string {
+	return `SELECT key FROM blocks` + q.where()
+}
+
+func (q Queries) KeysAfter() string {
+	return `SELECT key FROM blocks WHERE ` + q.and() + `key > $1 AND key LIKE $2 ESCAPE '\' ORDER BY key LIMIT $3`
+}
+
+func (q Queries) GetCheckpoint() string {
+	return `SELECT last_key FROM block_migrations WHERE ` + q.and() + `name = $1`
+}
+
+func (q Queries) PutCheckpoint() string {
+	return `INSERT INTO block_migrations (` + q.column() + `name, last_key) VALUES (` + q.value() + `$1, $2) ON CONFLICT (namespace, name) DO UPDATE SET last_key = excluded.last_key`
+}
+
+func (q Queries) DeleteCheckpoint() string {
+	return `DELETE FROM block_migrations WHERE ` + q.and() + `name = $1`
+}
+
+func (q Queries) PutEncrypted() string {
+	return `INSERT INTO blocks (` + q.column() + `key, data, key_id) SELECT ` + q.value() + `$1, $2, $3 WHERE NOT EXISTS ( SELECT key FROM blocks WHERE ` + q.and() + `key = $1)`
+}
+
+func (q Queries) GetEncrypted() string {
+	return `SELECT data, key_id FROM blocks WHERE ` + q.and() + `key = $1`
+}
+
+func (q Queries) GetSizeEncrypted() string {
+	return `SELECT octet_length(data), key_id FROM blocks WHERE ` + q.and() + `key = $1`
+}
+
+func (q Queries) QueryEncrypted() string {
+	return `SELECT key, data, key_id FROM blocks` + q.where()
+}
+
+func (q Queries) StaleEncrypted() string {
+	return `SELECT key, data, key_id FROM blocks WHERE ` + q.and() + `data IS NOT NULL AND key_id IS DISTINCT FROM $1 LIMIT $2`
+}
+
+func (q Queries) UpdateEncrypted() string {
+	return `UPDATE blocks SET data = $2, key_id = $3 WHERE ` + q.and() + `key = $1 AND key_id IS NOT DISTINCT FROM $4`
 }
 
 // Create returns a datastore connected to postgres
 func (opts *Options) Create() (*sqlds.Datastore, error) {
 	opts.setDefaults()
-	fmtstr := "postgresql:///%s?host=%s&port=%s&user=%s&password=%s&sslmode=disable"
-	constr := fmt.Sprintf(fmtstr, opts.Database, opts.Host, opts.Port, opts.User, opts.Password)
-	db, err := sql.Open("postgres", constr)
+	db, err := opts.open()
 	if err != nil {
 		return nil, err
 	}
 
-	return sqlds.NewDatastore(db, Queries{}), nil
+	var dsopts []sqlds.Option
+	if opts.Retry.MaxAttempts > 0 {
+		policy := opts.Retry
+		if policy.Classify == nil {
+			policy.Classify = IsTransient
+		}
+		dsopts = append(dsopts, sqlds.WithRetry(policy))
+	}
+
+	if opts.Breaker != nil {
+		cfg := *opts.Breaker
+		if cfg.IsFailure == nil {
+			cfg.IsFailure = IsConnectionError
+		}
+		dsopts = append(dsopts, sqlds.WithCircuitBreaker(cfg))
+	}
+
+	queries := Queries{Namespace: opts.Namespace}
+	if len(opts.Replicas) == 0 {
+		return sqlds.NewDatastore(db, queries, dsopts...), nil
+	}
+
+	var replicas []*sql.DB
+	for _, ropts := range opts.Replicas {
+		ropts.inherit(opts)
+		rdb, err := ropts.open()
+		if err != nil {
+			for _, r := range replicas {
+				r.Close()
+			}
+			db.Close()
+			return nil, err
+		}
+		replicas = append(replicas, rdb)
+	}
+
+	dsopts = append(dsopts, sqlds.WithReplicaPolicy(opts.ReplicaPolicy))
+	if opts.PrimaryFallback {
+		dsopts = append(dsopts, sqlds.WithPrimaryFallback())
+	}
+
+	return sqlds.NewDatastoreWithReplicas(db, replicas, queries, dsopts...), nil
+}
+
+// Open connects to the primary without creating a Datastore, e.g. to run
+// Migrate against it
+func (opts *Options) Open() (*sql.DB, error) {
+	opts.setDefaults()
+	return opts.open()
+}
+
+func (opts *Options) open() (*sql.DB, error) {
+	return sql.Open("postgres", opts.connString())
+}
+
+// connString leaves the password out when it is empty, so that the driver
+// falls back to PGPASSWORD and the pgpass file
+func (opts *Options) connString() string {
+	fmtstr := "postgresql:///%s?host=%s&port=%s&user=%s&sslmode=disable"
+	s := fmt.Sprintf(fmtstr, opts.Database, opts.Host, opts.Port, opts.User)
+	if opts.Password != "" {
+		s += "&password=" + url.QueryEscape(opts.Password)
+	}
+	return s
+}
+
+func (opts *Options) inherit(primary *Options) {
+	if opts.Host == "" {
+		opts.Host = primary.Host
+	}
+
+	if opts.Port == "" {
+		opts.Port = primary.Port
+	}
+
+	if opts.User == "" {
+		opts.User = primary.User
+	}
+
+	if opts.Password == "" {
+		opts.Password = primary.Password
+	}
+
+	if opts.Database == "" {
+		opts.Database = primary.Database
+	}
+}
+
+// WithDefaults returns a copy of opts with the unset connection fields
+// filled in the way Create fills them
+func (opts *Options) WithDefaults() Options {
+	o := *opts
+	o.setDefaults()
+	return o
 }
 
 func (opts *Options) setDefaults() {
@@ -0,0 +1,96 @@
+package postgres
+
+import (
+	"bytes"
+	"database/sql"
+	"strings"
+	"testing"
+
+	"github.com/whyrusleeping/sql-datastore"
+	"github.com/whyrusleeping/sql-datastore/internal/testdb"
+	"github.com/whyrusleeping/sql-datastore/sqldstest"
+)
+
+func TestSuite(t *testing.T) {
+	sqldstest.SubtestAll(t, sqldstest.Dialect{
+		Queries: Queries{},
+		Open: func(t testing.TB) (*sql.DB, func()) {
+			return testdb.Open(t, "")
+		},
+	})
+}
+
+func TestSuiteDedup(t *testing.T) {
+	sqldstest.SubtestAll(t, sqldstest.Dialect{
+		Queries: Queries{},
+		Open: func(t testing.TB) (*sql.DB, func()) {
+			return testdb.Open(t, "")
+		},
+		Options: []sqlds.Option{sqlds.WithDedup(sqlds.DedupConfig{})},
+	})
+}
+
+func TestSuiteChunked(t *testing.T) {
+	sqldstest.SubtestAll(t, sqldstest.Dialect{
+		Queries: Queries{},
+		Open: func(t testing.TB) (*sql.DB, func()) {
+			return testdb.Open(t, "")
+		},
+		Options: []sqlds.Option{sqlds.WithChunking(sqlds.ChunkConfig{Threshold: 1024, ChunkSize: 256})},
+	})
+}
+
+func TestSuiteSoftDelete(t *testing.T) {
+	sqldstest.SubtestAll(t, sqldstest.Dialect{
+		Queries: Queries{},
+		Open: func(t testing.TB) (*sql.DB, func()) {
+			return testdb.Open(t, "")
+		},
+		Options: []sqlds.Option{sqlds.WithSoftDelete(sqlds.SoftDeleteConfig{})},
+	})
+}
+
+func TestSuiteEncrypted(t *testing.T) {
+	kr, err := sqlds.NewKeyring("k1", bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sqldstest.SubtestAll(t, sqldstest.Dialect{
+		Queries: Queries{},
+		Open: func(t testing.TB) (*sql.DB, func()) {
+			return testdb.Open(t, "")
+		},
+		Options: []sqlds.Option{sqlds.WithEncryption(kr)},
+	})
+}
+
+func TestSuiteNamespaced(t *testing.T) {
+	sqldstest.SubtestAll(t, sqldstest.Dialect{
+		Queries: Queries{Namespace: "tenant"},
+		Open: func(t testing.TB) (*sql.DB, func()) {
+			return testdb.Open(t, "")
+		},
+	})
+}
+
+func BenchmarkSuite(b *testing.B) {
+	sqldstest.BenchmarkAll(b, sqldstest.Dialect{
+		Queries: Queries{},
+		Open: func(t testing.TB) (*sql.DB, func()) {
+			return testdb.Open(t, "")
+		},
+	})
+}
+
+func TestConnString(t *testing.T) {
+	opts := &Options{Host: "db", Port: "5432", User: "u", Database: "d"}
+	if s := opts.connString(); strings.Contains(s, "password") {
+		t.Fatalf("an empty password must be left to PGPASSWORD and pgpass: %s", s)
+	}
+
+	opts.Password = "p&ss word"
+	if s := opts.connString(); !strings.HasSuffix(s, "&password=p%26ss+word") {
+		t.Fatalf("password not escaped: %s", s)
+	}
+}
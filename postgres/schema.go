@@ -0,0 +1,52 @@
+package postgres
+
+import (
+	"database/sql"
+)
+
+// Schema lists the statements that create and upgrade the tables used by
+// Queries. Every statement is idempotent, so the list can be replayed
+// against an existing database.
+var Schema = []string{
+	`CREATE TABLE IF NOT EXISTS blocks (key TEXT NOT NULL UNIQUE, data BYTEA NOT NULL)`,
+	`ALTER TABLE blocks ADD COLUMN IF NOT EXISTS key_id TEXT`,
+	`CREATE TABLE IF NOT EXISTS block_changes (seq BIGSERIAL PRIMARY KEY, op TEXT NOT NULL, key TEXT NOT NULL, ts TIMESTAMPTZ NOT NULL DEFAULT now())`,
+	`CREATE INDEX IF NOT EXISTS block_changes_ts ON block_changes (ts)`,
+	`ALTER TABLE blocks ADD COLUMN IF NOT EXISTS namespace TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE blocks DROP CONSTRAINT IF EXISTS blocks_key_key`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS blocks_namespace_key ON blocks (namespace, key)`,
+	`CREATE INDEX IF NOT EXISTS blocks_key ON blocks (key)`,
+	`ALTER TABLE block_changes ADD COLUMN IF NOT EXISTS namespace TEXT NOT NULL DEFAULT ''`,
+	`CREATE INDEX IF NOT EXISTS block_changes_namespace ON block_changes (namespace, seq)`,
+	`CREATE TABLE IF NOT EXISTS block_contents (hash BYTEA PRIMARY KEY, data BYTEA NOT NULL, refs BIGINT NOT NULL)`,
+	`CREATE INDEX IF NOT EXISTS block_contents_orphans ON block_contents (hash) WHERE refs <= 0`,
+	`ALTER TABLE blocks ADD COLUMN IF NOT EXISTS content BYTEA`,
+	`ALTER TABLE blocks ALTER COLUMN data DROP NOT NULL`,
+	`ALTER TABLE blocks ADD COLUMN IF NOT EXISTS size BIGINT`,
+	`CREATE TABLE IF NOT EXISTS block_history (seq BIGSERIAL PRIMARY KEY, namespace TEXT NOT NULL DEFAULT '', key TEXT NOT NULL, data BYTEA, deleted BOOLEAN NOT NULL, ts TIMESTAMPTZ NOT NULL)`,
+	`CREATE INDEX IF NOT EXISTS block_history_key ON block_history (namespace, key, seq)`,
+	`CREATE INDEX IF NOT EXISTS block_history_ts ON block_history (ts)`,
+	`CREATE TABLE IF NOT EXISTS block_snapshots (namespace TEXT NOT NULL DEFAULT '', name TEXT NOT NULL, ts TIMESTAMPTZ NOT NULL, PRIMARY KEY (namespace, name))`,
+	`CREATE TABLE IF NOT EXISTS block_tombstones (seq BIGSERIAL PRIMARY KEY, namespace TEXT NOT NULL DEFAULT '', key TEXT NOT NULL, data BYTEA, key_id TEXT, deleted_at TIMESTAMPTZ NOT NULL)`,
+	`CREATE INDEX IF NOT EXISTS block_tombstones_key ON block_tombstones (namespace, key, seq)`,
+	`CREATE INDEX IF NOT EXISTS block_tombstones_deleted_at ON block_tombstones (deleted_at)`,
+	`CREATE TABLE IF NOT EXISTS block_chunks (namespace TEXT NOT NULL DEFAULT '', key TEXT NOT NULL, idx INTEGER NOT NULL, data BYTEA NOT NULL, PRIMARY KEY (namespace, key, idx))`,
+	`CREATE TABLE IF NOT EXISTS block_audit (seq BIGSERIAL PRIMARY KEY, namespace TEXT NOT NULL DEFAULT '', op TEXT NOT NULL, key TEXT NOT NULL, size BIGINT NOT NULL, caller TEXT NOT NULL, ts TIMESTAMPTZ NOT NULL)`,
+	`CREATE INDEX IF NOT EXISTS block_audit_ts ON block_audit (ts)`,
+	`ALTER TABLE block_changes ALTER COLUMN ts SET DEFAULT clock_timestamp()`,
+	`ALTER TABLE block_contents ADD COLUMN IF NOT EXISTS namespace TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE block_contents DROP CONSTRAINT IF EXISTS block_contents_pkey`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS block_contents_namespace_hash ON block_contents (namespace, hash)`,
+	`CREATE TABLE IF NOT EXISTS block_migrations (namespace TEXT NOT NULL DEFAULT '', name TEXT NOT NULL, last_key TEXT NOT NULL, PRIMARY KEY (namespace, name))`,
+}
+
+// Migrate applies Schema to db
+func Migrate(db *sql.DB) error {
+	for _, stmt := range Schema {
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
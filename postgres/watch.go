@@ -0,0 +1,206 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/lib/pq"
+)
+
+// ChangeChannel is the NOTIFY channel the change feed trigger publishes on
+const ChangeChannel = "blocks_changes"
+
+// ChangeFeedSchema installs a trigger that numbers every insert and delete
+// on blocks from blocks_change_seq, stamps inserted rows' seq column with
+// the number, and publishes the change, with the row's namespace, on
+// ChangeChannel. Like Schema, it can be replayed, which also upgrades
+// triggers installed before.
+//
+// The trigger is deferred to commit and takes an advisory lock before it
+// draws a number, so committing writers take their numbers one at a time
+// and the numbers follow commit order, the order postgres delivers the
+// notifications in. A number is only skipped when the transaction that
+// drew it fails to commit after all, which is rare. The lock serialises
+// the commits of writers to blocks.
+var ChangeFeedSchema = []string{
+	`CREATE SEQUENCE IF NOT EXISTS blocks_change_seq`,
+	`ALTER TABLE blocks ADD COLUMN IF NOT EXISTS seq BIGINT`,
+	`CREATE OR REPLACE FUNCTION blocks_notify() RETURNS trigger AS $$
+DECLARE
+	s BIGINT;
+BEGIN
+	PERFORM pg_advisory_xact_lock(hashtext('blocks_change_seq'));
+	s := nextval('blocks_change_seq');
+	IF TG_OP = 'DELETE' THEN
+		PERFORM pg_notify('` + ChangeChannel + `', json_build_object('op', 'delete', 'namespace', OLD.namespace, 'key', OLD.key, 'seq', s)::text);
+		RETURN NULL;
+	END IF;
+	UPDATE blocks SET seq = s WHERE namespace = NEW.namespace AND key = NEW.key;
+	PERFORM pg_notify('` + ChangeChannel + `', json_build_object('op', 'put', 'namespace', NEW.namespace, 'key', NEW.key, 'seq', s)::text);
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql`,
+	`DROP TRIGGER IF EXISTS blocks_notify ON blocks`,
+	`CREATE CONSTRAINT TRIGGER blocks_notify AFTER INSERT OR DELETE ON blocks DEFERRABLE INITIALLY DEFERRED FOR EACH ROW EXECUTE PROCEDURE blocks_notify()`,
+}
+
+// InstallChangeFeed applies ChangeFeedSchema to db
+func InstallChangeFeed(db *sql.DB) error {
+	for _, stmt := range ChangeFeedSchema {
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ChangeOp is the kind of a ChangeEvent
+type ChangeOp string
+
+const (
+	// ChangePut is sent when a key is inserted
+	ChangePut ChangeOp = "put"
+	// ChangeDelete is sent when a key is deleted
+	ChangeDelete ChangeOp = "delete"
+	// ChangeGap is sent when notifications may have been lost, because
+	// the listener's connection dropped or a sequence number was skipped.
+	// Consumers should resynchronise with a Query.
+	ChangeGap ChangeOp = "gap"
+)
+
+// ChangeEvent describes a change to the blocks table
+type ChangeEvent struct {
+	Op  ChangeOp
+	Key ds.Key
+	// Seq is the change's sequence number. Changes to every namespace
+	// share the sequence, which counts up by one in commit order: see
+	// ChangeFeedSchema. For ChangeGap it is the sequence number of the last
+	// change seen before the gap, or 0 if none was.
+	Seq int64
+}
+
+// sequence follows the sequence numbers of the feed to notice changes
+// that were not delivered
+type sequence struct {
+	last int64
+}
+
+// next records seq and reports whether changes were missed before it
+func (s *sequence) next(seq int64) bool {
+	missed := s.last != 0 && seq != s.last+1
+	s.last = seq
+	return missed
+}
+
+// parseChange decodes a notification into its event and the namespace of
+// the changed row
+func parseChange(payload string) (ChangeEvent, string, error) {
+	var raw struct {
+		Op        ChangeOp `json:"op"`
+		Namespace string   `json:"namespace"`
+		Key       string   `json:"key"`
+		Seq       int64    `json:"seq"`
+	}
+
+	if err := json.Unmarshal([]byte(payload), &raw); err != nil {
+		return ChangeEvent{}, "", err
+	}
+
+	return ChangeEvent{Op: raw.Op, Key: ds.RawKey(raw.Key), Seq: raw.Seq}, raw.Namespace, nil
+}
+
+func matchesPrefix(key ds.Key, prefix string) bool {
+	if prefix == "" || prefix == "/" {
+		return true
+	}
+
+	p := ds.NewKey(prefix)
+	return key.Equal(p) || strings.HasPrefix(key.String(), p.String()+"/")
+}
+
+// Watch streams changes to keys at or below prefix in opts.Namespace until
+// ctx is done, at which point the channel is closed. Changes arrive in
+// commit order. A ChangeGap event is sent whenever changes may have been
+// missed: when the listener's connection dropped, after which it is
+// re-established automatically, and when the sequence numbers of the
+// feed skip one. Consumers that need to resume from a cursor after a
+// restart should follow the sqlds change log instead. InstallChangeFeed
+// must have been run against the database.
+func (opts *Options) Watch(ctx context.Context, prefix string) (<-chan ChangeEvent, error) {
+	opts.setDefaults()
+
+	l := pq.NewListener(opts.connString(), time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("sqlds: change feed listener: %s", err)
+		}
+	})
+
+	if err := l.Listen(ChangeChannel); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	out := make(chan ChangeEvent, 32)
+	go func() {
+		defer close(out)
+		defer l.Close()
+
+		var seq sequence
+		send := func(ev ChangeEvent) bool {
+			select {
+			case out <- ev:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case n := <-l.Notify:
+				if n == nil {
+					// the listener reconnected; anything sent while it
+					// was down is gone
+					if !send(ChangeEvent{Op: ChangeGap, Seq: seq.last}) {
+						return
+					}
+					seq = sequence{}
+					continue
+				}
+
+				ev, ns, err := parseChange(n.Extra)
+				if err != nil {
+					log.Printf("sqlds: bad change notification %q: %s", n.Extra, err)
+					continue
+				}
+
+				// other namespaces' changes take sequence numbers too
+				last := seq.last
+				if seq.next(ev.Seq) && !send(ChangeEvent{Op: ChangeGap, Seq: last}) {
+					return
+				}
+
+				if ns != opts.Namespace || !matchesPrefix(ev.Key, prefix) {
+					continue
+				}
+
+				if !send(ev) {
+					return
+				}
+			case <-time.After(90 * time.Second):
+				// make sure a silently dropped connection is noticed
+				go l.Ping()
+			}
+		}
+	}()
+
+	return out, nil
+}
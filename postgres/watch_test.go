@@ -0,0 +1,132 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/whyrusleeping/sql-datastore"
+	"github.com/whyrusleeping/sql-datastore/internal/testdb"
+)
+
+func TestParseChange(t *testing.T) {
+	ev, ns, err := parseChange(`{"op" : "put", "namespace" : "a", "key" : "/blocks/abc", "seq" : 7}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ev.Op != ChangePut || !ev.Key.Equal(ds.NewKey("/blocks/abc")) || ev.Seq != 7 || ns != "a" {
+		t.Fatalf("unexpected event: %+v in %q", ev, ns)
+	}
+
+	if !matchesPrefix(ev.Key, "/blocks") || matchesPrefix(ev.Key, "/block") {
+		t.Fatal("prefix must match whole path components")
+	}
+}
+
+func TestSequence(t *testing.T) {
+	var s sequence
+	for _, step := range []struct {
+		seq    int64
+		missed bool
+	}{
+		{5, false},
+		{6, false},
+		{8, true},
+		{9, false},
+	} {
+		if s.next(step.seq) != step.missed {
+			t.Fatalf("sequence number %d: expected missed to be %v", step.seq, step.missed)
+		}
+	}
+}
+
+var createTable = regexp.MustCompile(`^CREATE TABLE IF NOT EXISTS (\w+)`)
+
+// dropSchema drops everything Migrate and InstallChangeFeed create
+func dropSchema(db *sql.DB) {
+	for _, stmt := range Schema {
+		if m := createTable.FindStringSubmatch(stmt); m != nil {
+			db.Exec("DROP TABLE IF EXISTS " + m[1])
+		}
+	}
+	db.Exec("DROP FUNCTION IF EXISTS blocks_notify()")
+	db.Exec("DROP SEQUENCE IF EXISTS blocks_change_seq")
+}
+
+// TestWatch requires a postgres database named "test_datastore"
+func TestWatch(t *testing.T) {
+	testdb.RequirePostgres(t)
+
+	opts := &Options{Database: "test_datastore"}
+	d, err := opts.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	db, err := opts.open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		dropSchema(db)
+		db.Close()
+	}()
+
+	if err := Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := InstallChangeFeed(db); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	events, err := opts.Watch(ctx, "/blocks")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := sqlds.NewNamespacedDatastore(db, Queries{}, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Put(ds.NewKey("/blocks/a"), []byte("other")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put(ds.NewKey("/other/x"), []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put(ds.NewKey("/blocks/a"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete(ds.NewKey("/blocks/a")); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []ChangeOp{ChangePut, ChangeDelete}
+	var lastSeq int64
+	for _, op := range expect {
+		select {
+		case ev := <-events:
+			if ev.Op != op || !ev.Key.Equal(ds.NewKey("/blocks/a")) {
+				t.Fatalf("expected %s of /blocks/a, got %+v", op, ev)
+			}
+			if lastSeq != 0 && ev.Seq != lastSeq+1 {
+				t.Fatalf("expected sequence number %d, got %d", lastSeq+1, ev.Seq)
+			}
+			lastSeq = ev.Seq
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for ", op)
+		}
+	}
+
+	cancel()
+	for range events {
+	}
+}
@@ -0,0 +1,129 @@
+package sqlds
+
+import (
+	"database/sql"
+	"sync/atomic"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// ReplicaPolicy selects which replica serves a read
+type ReplicaPolicy int
+
+const (
+	// RoundRobin cycles through the replicas in order
+	RoundRobin ReplicaPolicy = iota
+	// LeastLoaded picks the replica with the fewest connections in use
+	LeastLoaded
+)
+
+type replicaSet struct {
+	// accessed atomically, kept first for 64-bit alignment
+	next uint64
+
+	dbs      []*sql.DB
+	policy   ReplicaPolicy
+	fallback bool
+}
+
+// NewDatastoreWithReplicas returns a datastore that sends writes and
+// batches to primary and spreads Get, Has, GetSize and Query across
+// replicas. With no replicas it behaves like NewDatastore.
+func NewDatastoreWithReplicas(primary *sql.DB, replicas []*sql.DB, queries Queries, opts ...Option) *Datastore {
+	if len(replicas) == 0 {
+		return NewDatastore(primary, queries, opts...)
+	}
+
+	// the replicas are set up as an option, before any background work
+	// that reads from them starts
+	opts = append(opts[:len(opts):len(opts)], withReplicas(replicas))
+	return NewDatastore(primary, queries, opts...)
+}
+
+func withReplicas(dbs []*sql.DB) Option {
+	return func(d *Datastore) {
+		if d.replicas == nil {
+			d.replicas = &replicaSet{}
+		}
+		d.replicas.dbs = dbs
+	}
+}
+
+// WithReplicaPolicy sets how reads are distributed across replicas
+func WithReplicaPolicy(p ReplicaPolicy) Option {
+	return func(d *Datastore) {
+		if d.replicas == nil {
+			d.replicas = &replicaSet{}
+		}
+		d.replicas.policy = p
+	}
+}
+
+// WithPrimaryFallback retries reads that found nothing on a replica
+// against the primary, hiding replication lag for freshly written keys.
+func WithPrimaryFallback() Option {
+	return func(d *Datastore) {
+		if d.replicas == nil {
+			d.replicas = &replicaSet{}
+		}
+		d.replicas.fallback = true
+	}
+}
+
+func (r *replicaSet) pick() *sql.DB {
+	switch r.policy {
+	case LeastLoaded:
+		best := r.dbs[0]
+		inUse := best.Stats().InUse
+		for _, db := range r.dbs[1:] {
+			if n := db.Stats().InUse; n < inUse {
+				best, inUse = db, n
+			}
+		}
+		return best
+	default:
+		n := atomic.AddUint64(&r.next, 1)
+		return r.dbs[(n-1)%uint64(len(r.dbs))]
+	}
+}
+
+func (r *replicaSet) close() error {
+	var firstErr error
+	for _, db := range r.dbs {
+		if err := db.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// reader returns the database that should serve the next read
+func (d *Datastore) reader() *sql.DB {
+	if d.replicas == nil || len(d.replicas.dbs) == 0 {
+		return d.db
+	}
+
+	return d.replicas.pick()
+}
+
+// read runs fn against a reader, retrying on the primary when fn reports
+// ds.ErrNotFound and primary fallback is enabled. Transient errors are
+// retried according to the retry policy, each time on a freshly picked
+// reader.
+func (d *Datastore) read(fn func(db *sql.DB) error) error {
+	return d.retry(func() error {
+		var replica bool
+		err := d.guardRead(func(db *sql.DB) error {
+			replica = db != d.db
+			return fn(db)
+		})
+		if err == ds.ErrNotFound && replica && d.replicas.fallback {
+			err = d.guard(func() error {
+				return fn(d.db)
+			})
+		}
+
+		return err
+	})
+}
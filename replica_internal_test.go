@@ -0,0 +1,24 @@
+package sqlds
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func TestReplicaRoundRobin(t *testing.T) {
+	a, _ := sql.Open("postgres", "")
+	b, _ := sql.Open("postgres", "")
+	defer a.Close()
+	defer b.Close()
+
+	d := NewDatastoreWithReplicas(a, []*sql.DB{a, b}, nil)
+	seen := []*sql.DB{d.reader(), d.reader(), d.reader()}
+	if seen[0] != a || seen[1] != b || seen[2] != a {
+		t.Fatal("reads not distributed round-robin")
+	}
+
+	d = NewDatastore(a, nil, WithReplicaPolicy(LeastLoaded))
+	if d.reader() != a {
+		t.Fatal("reads without replicas must go to the primary")
+	}
+}
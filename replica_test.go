@@ -0,0 +1,97 @@
+package sqlds_test
+
+import (
+	"database/sql"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	sqlds "github.com/whyrusleeping/sql-datastore"
+	"github.com/whyrusleeping/sql-datastore/internal/testdb"
+	"github.com/whyrusleeping/sql-datastore/postgres"
+)
+
+// newLaggingReplica opens a second, empty test database, standing in for a
+// replica that has not caught up yet.
+func newLaggingReplica(t *testing.T) (*sql.DB, func()) {
+	return testdb.Open(t, "replica")
+}
+
+func TestReplicaPrimaryFallback(t *testing.T) {
+	p, done := newDS(t)
+	defer done()
+
+	replica, cleanup := newLaggingReplica(t)
+	defer cleanup()
+
+	k := ds.NewKey("/fresh")
+	if err := p.Put(k, []byte("fresh")); err != nil {
+		t.Fatal(err)
+	}
+
+	d := sqlds.NewDatastoreWithReplicas(p.DB(), []*sql.DB{replica}, postgres.Queries{})
+	if _, err := d.Get(k); err != ds.ErrNotFound {
+		t.Fatal("expected lagging replica to miss, got: ", err)
+	}
+
+	d = sqlds.NewDatastoreWithReplicas(p.DB(), []*sql.DB{replica}, postgres.Queries{}, sqlds.WithPrimaryFallback())
+	val, err := d.Get(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(val) != "fresh" {
+		t.Fatal("value received on get wasnt what we expected:", val)
+	}
+
+	has, err := d.Has(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !has {
+		t.Fatal("has should fall back to the primary")
+	}
+
+	size, err := d.GetSize(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != len("fresh") {
+		t.Fatalf("incorrect size: expected %d, got %d", len("fresh"), size)
+	}
+
+	has, err = d.Has(ds.NewKey("/missing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if has {
+		t.Fatal("has returned true for key we don't have")
+	}
+}
+
+func TestReplicaBloomFilterFromPrimary(t *testing.T) {
+	p, done := newDS(t)
+	defer done()
+
+	replica, cleanup := newLaggingReplica(t)
+	defer cleanup()
+
+	k := ds.NewKey("/fresh")
+	if err := p.Put(k, []byte("fresh")); err != nil {
+		t.Fatal(err)
+	}
+
+	d := sqlds.NewDatastoreWithReplicas(p.DB(), []*sql.DB{replica}, postgres.Queries{},
+		sqlds.WithBloomFilter(sqlds.DefaultBloomConfig), sqlds.WithPrimaryFallback())
+	defer d.Close()
+	if err := d.RebuildBloomFilter(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a filter built from the lagging replica would rule the key out
+	has, err := d.Has(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !has {
+		t.Fatal("bloom filter missed a key that is on the primary")
+	}
+}
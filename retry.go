@@ -0,0 +1,131 @@
+package sqlds
+
+import (
+	"database/sql/driver"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// RetryPolicy describes how idempotent operations are retried after a
+// transient database error.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of tries, including the first
+	MaxAttempts int
+	// BaseDelay is the backoff before the first retry; it doubles with
+	// every further attempt
+	BaseDelay time.Duration
+	// MaxDelay caps the backoff
+	MaxDelay time.Duration
+	// Classify reports whether an error is worth retrying. IsTransient is
+	// used when it is nil.
+	Classify func(error) bool
+}
+
+// DefaultRetryPolicy tries an operation up to five times, backing off from
+// 50ms to at most 2s.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	BaseDelay:   50 * time.Millisecond,
+	MaxDelay:    2 * time.Second,
+}
+
+// WithRetry retries Get, Has, GetSize, Query and Puts of content-addressed
+// keys (those below BlocksPrefix) according to p. Other writes are never
+// retried, since they may have taken effect before the error surfaced.
+func WithRetry(p RetryPolicy) Option {
+	return func(d *Datastore) {
+		d.retryPolicy = &p
+	}
+}
+
+// TransientSQLState reports whether a SQLSTATE code denotes a failure that
+// is expected to go away on its own: connection exceptions, serialization
+// failures, deadlocks, server shutdowns and connection limits.
+func TransientSQLState(code string) bool {
+	if strings.HasPrefix(code, "08") {
+		return true
+	}
+
+	switch code {
+	case "40001", // serialization_failure
+		"40P01", // deadlock_detected
+		"53300", // too_many_connections
+		"57P01", // admin_shutdown
+		"57P02", // crash_shutdown
+		"57P03": // cannot_connect_now
+		return true
+	}
+
+	return false
+}
+
+// IsTransient is the default retry classifier. It recognises broken
+// connections, network errors and drivers whose errors expose their
+// SQLSTATE through a SQLState() method.
+func IsTransient(err error) bool {
+	switch err {
+	case nil, ds.ErrNotFound:
+		return false
+	case driver.ErrBadConn, io.EOF, io.ErrUnexpectedEOF:
+		return true
+	}
+
+	if e, ok := err.(interface{ SQLState() string }); ok {
+		return TransientSQLState(e.SQLState())
+	}
+
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+
+	switch err {
+	case syscall.ECONNRESET, syscall.ECONNREFUSED, syscall.EPIPE:
+		return true
+	}
+
+	return false
+}
+
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.BaseDelay << uint(attempt)
+	if delay <= 0 || (p.MaxDelay > 0 && delay > p.MaxDelay) {
+		delay = p.MaxDelay
+	}
+
+	if delay <= 0 {
+		return 0
+	}
+
+	// full jitter keeps clients that failed together from retrying together
+	return time.Duration(rand.Int63n(int64(delay)))
+}
+
+// retry runs fn until it succeeds, fails with an error the policy does not
+// consider transient, or runs out of attempts.
+func (d *Datastore) retry(fn func() error) error {
+	p := d.retryPolicy
+	if p == nil {
+		return fn()
+	}
+
+	classify := p.Classify
+	if classify == nil {
+		classify = IsTransient
+	}
+
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = fn()
+		if err == nil || err == ds.ErrNotFound || attempt+1 >= p.MaxAttempts || !classify(err) {
+			return err
+		}
+
+		time.Sleep(p.backoff(attempt))
+	}
+}
@@ -0,0 +1,83 @@
+package sqlds
+
+import (
+	"database/sql/driver"
+	"errors"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+type sqlStateError string
+
+func (e sqlStateError) Error() string    { return "sqlstate " + string(e) }
+func (e sqlStateError) SQLState() string { return string(e) }
+
+func TestIsTransient(t *testing.T) {
+	for _, err := range []error{
+		driver.ErrBadConn,
+		sqlStateError("40001"),
+		sqlStateError("08006"),
+		sqlStateError("57P01"),
+	} {
+		if !IsTransient(err) {
+			t.Errorf("%s should be transient", err)
+		}
+	}
+
+	for _, err := range []error{
+		nil,
+		ds.ErrNotFound,
+		sqlStateError("23505"),
+		errors.New("syntax error"),
+	} {
+		if IsTransient(err) {
+			t.Errorf("%v should not be transient", err)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	d := NewDatastore(nil, nil, WithRetry(RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   time.Millisecond,
+		MaxDelay:    5 * time.Millisecond,
+	}))
+
+	calls := 0
+	err := d.retry(func() error {
+		calls++
+		if calls < 3 {
+			return driver.ErrBadConn
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 {
+		t.Fatalf("expected 3 attempts, got %d", calls)
+	}
+
+	calls = 0
+	err = d.retry(func() error {
+		calls++
+		return driver.ErrBadConn
+	})
+	if err != driver.ErrBadConn {
+		t.Fatal("expected last error after running out of attempts, got: ", err)
+	}
+	if calls != 3 {
+		t.Fatalf("expected 3 attempts, got %d", calls)
+	}
+
+	calls = 0
+	err = d.retry(func() error {
+		calls++
+		return ds.ErrNotFound
+	})
+	if err != ds.ErrNotFound || calls != 1 {
+		t.Fatal("ErrNotFound must not be retried")
+	}
+}
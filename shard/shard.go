@@ -0,0 +1,635 @@
+// Package shard spreads a datastore across several sqlds.Datastore
+// backends using consistent hashing.
+package shard
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	"github.com/whyrusleeping/sql-datastore"
+)
+
+// replicas is the number of points each shard owns on the hash ring
+const replicas = 128
+
+type ring struct {
+	points []uint64
+	owners map[uint64]string
+}
+
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
+
+func newRing(names []string) *ring {
+	r := &ring{owners: make(map[uint64]string)}
+	for _, name := range names {
+		for i := 0; i < replicas; i++ {
+			p := hashString(name + "#" + strconv.Itoa(i))
+			r.points = append(r.points, p)
+			r.owners[p] = name
+		}
+	}
+
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+func (r *ring) owner(key ds.Key) string {
+	h := hashString(key.String())
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+
+	return r.owners[r.points[i]]
+}
+
+// Datastore is a ds.Batching that consistently hashes keys across a set of
+// named sqlds.Datastore shards.
+type Datastore struct {
+	mu     sync.RWMutex
+	shards map[string]*sqlds.Datastore
+	ring   *ring
+
+	// prev is the ring before the last AddShard, kept until Rebalance has
+	// moved every key to its new owner
+	prev *ring
+
+	// moving is held by Rebalance while it moves a batch of keys, and
+	// shared by writes, so that a key written or deleted while it moves
+	// is not brought back with its old value
+	moving sync.RWMutex
+}
+
+// New returns a sharded datastore over shards, keyed by a stable name.
+// Names, not their order, decide key placement, so keep them stable.
+func New(shards map[string]*sqlds.Datastore) (*Datastore, error) {
+	if len(shards) == 0 {
+		return nil, errors.New("shard: need at least one shard")
+	}
+
+	d := &Datastore{shards: make(map[string]*sqlds.Datastore)}
+	for name, s := range shards {
+		d.shards[name] = s
+	}
+
+	d.ring = newRing(d.names())
+	return d, nil
+}
+
+func (d *Datastore) names() []string {
+	var names []string
+	for name := range d.shards {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// AddShard adds a backend to the ring. Keys owned by the new shard stay
+// readable from their old location until Rebalance moves them, so the
+// datastore can keep serving traffic in the meantime.
+func (d *Datastore) AddShard(name string, s *sqlds.Datastore) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.shards[name]; ok {
+		return fmt.Errorf("shard: %s already exists", name)
+	}
+
+	if d.prev != nil {
+		return errors.New("shard: previous rebalance has not finished")
+	}
+
+	d.shards[name] = s
+	d.prev = d.ring
+	d.ring = newRing(d.names())
+	return nil
+}
+
+// Rebalance moves every key that is stored on a shard other than its
+// owner, batchSize keys per batch. It returns the number of keys moved.
+func (d *Datastore) Rebalance(batchSize int) (int, error) {
+	if batchSize <= 0 {
+		return 0, errors.New("shard: batch size must be positive")
+	}
+
+	d.mu.RLock()
+	names := d.names()
+	d.mu.RUnlock()
+
+	moved := 0
+	for _, name := range names {
+		n, err := d.rebalanceShard(name, batchSize)
+		moved += n
+		if err != nil {
+			return moved, err
+		}
+	}
+
+	d.mu.Lock()
+	d.prev = nil
+	d.mu.Unlock()
+
+	return moved, nil
+}
+
+func (d *Datastore) rebalanceShard(name string, batchSize int) (int, error) {
+	d.mu.RLock()
+	src := d.shards[name]
+	d.mu.RUnlock()
+
+	// only keys are listed; values are read as each batch moves
+	keys := &pager{s: src, size: batchSize, left: -1}
+
+	moved := 0
+	var pending []ds.Key
+	flush := func() error {
+		n, err := d.move(src, pending)
+		moved += n
+		pending = pending[:0]
+		return err
+	}
+
+	for {
+		k, ok := keys.next()
+		if !ok {
+			break
+		}
+
+		if d.ownerOf(k) == name {
+			continue
+		}
+
+		pending = append(pending, k)
+		if len(pending) >= batchSize {
+			if err := flush(); err != nil {
+				return moved, err
+			}
+		}
+	}
+
+	if keys.err != nil {
+		return moved, keys.err
+	}
+
+	if err := flush(); err != nil {
+		return moved, err
+	}
+
+	return moved, nil
+}
+
+// move copies keys from src to their owners and only then removes them
+// from src. Writes through d wait for it, and each key is read again
+// under that lock, so a key that was deleted since it was listed is
+// skipped, and one that was written to its new owner keeps that value.
+// Writes that bypass d, e.g. from another process, are not guarded.
+func (d *Datastore) move(src *sqlds.Datastore, keys []ds.Key) (int, error) {
+	if len(keys) == 0 {
+		return 0, nil
+	}
+
+	d.moving.Lock()
+	defer d.moving.Unlock()
+
+	b := d.newBatch()
+	var gone []ds.Key
+	for _, k := range keys {
+		value, err := src.Get(k)
+		if err == ds.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		owner, _ := d.locate(k)
+		has, err := owner.Has(k)
+		if err != nil {
+			return 0, err
+		}
+
+		if !has {
+			if err := b.Put(k, value); err != nil {
+				return 0, err
+			}
+		}
+		gone = append(gone, k)
+	}
+
+	if err := b.commit(); err != nil {
+		return 0, err
+	}
+
+	del, err := src.Batch()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, k := range gone {
+		if err := del.Delete(k); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := del.Commit(); err != nil {
+		return 0, err
+	}
+
+	return len(gone), nil
+}
+
+func (d *Datastore) ownerOf(key ds.Key) string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.ring.owner(key)
+}
+
+// locate returns the shard that owns key and, while a rebalance is
+// pending, the shard that owned it before.
+func (d *Datastore) locate(key ds.Key) (owner, prev *sqlds.Datastore) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	owner = d.shards[d.ring.owner(key)]
+	if d.prev != nil {
+		if p := d.shards[d.prev.owner(key)]; p != owner {
+			prev = p
+		}
+	}
+
+	return owner, prev
+}
+
+func (d *Datastore) Put(key ds.Key, value []byte) error {
+	d.moving.RLock()
+	defer d.moving.RUnlock()
+
+	owner, _ := d.locate(key)
+	return owner.Put(key, value)
+}
+
+func (d *Datastore) Get(key ds.Key) ([]byte, error) {
+	owner, prev := d.locate(key)
+	value, err := owner.Get(key)
+	if err == ds.ErrNotFound && prev != nil {
+		return prev.Get(key)
+	}
+
+	return value, err
+}
+
+func (d *Datastore) Has(key ds.Key) (bool, error) {
+	owner, prev := d.locate(key)
+	has, err := owner.Has(key)
+	if err == nil && !has && prev != nil {
+		return prev.Has(key)
+	}
+
+	return has, err
+}
+
+func (d *Datastore) GetSize(key ds.Key) (int, error) {
+	owner, prev := d.locate(key)
+	size, err := owner.GetSize(key)
+	if err == ds.ErrNotFound && prev != nil {
+		return prev.GetSize(key)
+	}
+
+	return size, err
+}
+
+func (d *Datastore) Delete(key ds.Key) error {
+	d.moving.RLock()
+	defer d.moving.RUnlock()
+
+	owner, prev := d.locate(key)
+	err := owner.Delete(key)
+	if prev == nil {
+		return err
+	}
+
+	perr := prev.Delete(key)
+	if err == ds.ErrNotFound {
+		return perr
+	}
+
+	if perr != nil && perr != ds.ErrNotFound {
+		return perr
+	}
+
+	return err
+}
+
+// pageSize is the number of keys Query reads from a shard at a time
+const pageSize = 256
+
+// Query merges the keys of every shard in key order, reading them a page
+// at a time, so results stream however large the shards are. Values are
+// read as the merged keys are returned. Filters, orders other than by
+// key, offset and limit are applied to the merged stream; without filters
+// or other orders, no shard is read past offset+limit keys.
+func (d *Datastore) Query(q dsq.Query) (dsq.Results, error) {
+	d.mu.RLock()
+	var shards []*sqlds.Datastore
+	for _, name := range d.names() {
+		shards = append(shards, d.shards[name])
+	}
+	d.mu.RUnlock()
+
+	left := -1
+	if q.Limit != 0 && len(q.Filters) == 0 && orderedByKey(q.Orders) {
+		left = q.Offset + q.Limit
+	}
+
+	m := &merger{}
+	for _, s := range shards {
+		p := &pager{s: s, prefix: q.Prefix, size: pageSize, left: left}
+		if err := m.add(p); err != nil {
+			return nil, err
+		}
+	}
+
+	next := m.next
+	if !q.KeysOnly {
+		next = func() (dsq.Result, bool) {
+			for {
+				r, ok := m.next()
+				if !ok || r.Error != nil {
+					return r, ok
+				}
+
+				r.Value, r.Error = d.Get(ds.RawKey(r.Key))
+				if r.Error == ds.ErrNotFound {
+					// deleted since its key was listed
+					continue
+				}
+				return r, true
+			}
+		}
+	}
+
+	var out dsq.Results = dsq.ResultsFromIterator(q, dsq.Iterator{
+		Next:  next,
+		Close: func() error { return nil },
+	})
+
+	for _, f := range q.Filters {
+		out = dsq.NaiveFilter(out, f)
+	}
+
+	if !orderedByKey(q.Orders) {
+		out = dsq.NaiveOrder(out, q.Orders...)
+	}
+
+	if q.Offset != 0 {
+		out = dsq.NaiveOffset(out, q.Offset)
+	}
+
+	if q.Limit != 0 {
+		out = dsq.NaiveLimit(out, q.Limit)
+	}
+
+	return out, nil
+}
+
+func orderedByKey(orders []dsq.Order) bool {
+	if len(orders) == 0 {
+		return true
+	}
+
+	_, ok := orders[0].(dsq.OrderByKey)
+	return ok && len(orders) == 1
+}
+
+// pager lists the keys of a shard below prefix in key order, size keys at
+// a time, stopping after left keys unless left is negative
+type pager struct {
+	s      *sqlds.Datastore
+	prefix string
+	size   int
+	left   int
+
+	after ds.Key
+	page  []ds.Key
+	done  bool
+	err   error
+}
+
+func (p *pager) next() (ds.Key, bool) {
+	for len(p.page) == 0 {
+		if p.done || p.err != nil {
+			return ds.Key{}, false
+		}
+
+		n := p.size
+		if p.left >= 0 && p.left < n {
+			n = p.left
+		}
+		if n == 0 {
+			p.done = true
+			continue
+		}
+
+		p.page, p.err = p.s.KeysAfter(p.prefix, p.after, n)
+		if len(p.page) < n {
+			p.done = true
+		}
+		if len(p.page) > 0 {
+			p.after = p.page[len(p.page)-1]
+		}
+		if p.left >= 0 {
+			p.left -= len(p.page)
+		}
+	}
+
+	k := p.page[0]
+	p.page = p.page[1:]
+	return k, true
+}
+
+type cursor struct {
+	p    *pager
+	head ds.Key
+}
+
+// merger is a k-way merge of the key-ordered shard pagers. Keys present on
+// two shards during a rebalance are only returned once.
+type merger struct {
+	cursors []*cursor
+	last    string
+	started bool
+	err     error
+}
+
+func (m *merger) add(p *pager) error {
+	c := &cursor{p: p}
+	if m.advance(c) {
+		heap.Push(m, c)
+	}
+	return m.err
+}
+
+func (m *merger) advance(c *cursor) bool {
+	k, ok := c.p.next()
+	if !ok {
+		if c.p.err != nil && m.err == nil {
+			m.err = c.p.err
+		}
+		return false
+	}
+
+	c.head = k
+	return true
+}
+
+func (m *merger) next() (dsq.Result, bool) {
+	for m.err == nil && m.Len() > 0 {
+		c := m.cursors[0]
+		k := c.head.String()
+		if m.advance(c) {
+			heap.Fix(m, 0)
+		} else {
+			heap.Pop(m)
+		}
+
+		if m.started && k == m.last {
+			continue
+		}
+
+		m.started = true
+		m.last = k
+		return dsq.Result{Entry: dsq.Entry{Key: k}}, true
+	}
+
+	if m.err != nil {
+		err := m.err
+		m.err = nil
+		m.cursors = nil
+		return dsq.Result{Error: err}, true
+	}
+
+	return dsq.Result{}, false
+}
+
+func (m *merger) Len() int { return len(m.cursors) }
+
+func (m *merger) Less(i, j int) bool {
+	return m.cursors[i].head.String() < m.cursors[j].head.String()
+}
+
+func (m *merger) Swap(i, j int) { m.cursors[i], m.cursors[j] = m.cursors[j], m.cursors[i] }
+
+func (m *merger) Push(x interface{}) { m.cursors = append(m.cursors, x.(*cursor)) }
+
+func (m *merger) Pop() interface{} {
+	old := m.cursors
+	c := old[len(old)-1]
+	m.cursors = old[:len(old)-1]
+	return c
+}
+
+func (d *Datastore) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var firstErr error
+	for _, s := range d.shards {
+		if err := s.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+type batch struct {
+	d       *Datastore
+	batches map[*sqlds.Datastore]ds.Batch
+}
+
+func (d *Datastore) newBatch() *batch {
+	return &batch{d: d, batches: make(map[*sqlds.Datastore]ds.Batch)}
+}
+
+// Batch returns a batch that groups operations per shard. Commit commits
+// each shard's transaction in turn, so a failure can leave earlier shards
+// committed.
+func (d *Datastore) Batch() (ds.Batch, error) {
+	return d.newBatch(), nil
+}
+
+func (b *batch) shard(s *sqlds.Datastore) (ds.Batch, error) {
+	if sb, ok := b.batches[s]; ok {
+		return sb, nil
+	}
+
+	sb, err := s.Batch()
+	if err != nil {
+		return nil, err
+	}
+
+	b.batches[s] = sb
+	return sb, nil
+}
+
+func (b *batch) Put(key ds.Key, value []byte) error {
+	owner, _ := b.d.locate(key)
+	sb, err := b.shard(owner)
+	if err != nil {
+		return err
+	}
+
+	return sb.Put(key, value)
+}
+
+func (b *batch) Delete(key ds.Key) error {
+	owner, prev := b.d.locate(key)
+	for _, s := range []*sqlds.Datastore{owner, prev} {
+		if s == nil {
+			continue
+		}
+
+		sb, err := b.shard(s)
+		if err != nil {
+			return err
+		}
+
+		if err := sb.Delete(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b *batch) Commit() error {
+	b.d.moving.RLock()
+	defer b.d.moving.RUnlock()
+
+	return b.commit()
+}
+
+func (b *batch) commit() error {
+	for _, sb := range b.batches {
+		if err := sb.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+var _ ds.Batching = (*Datastore)(nil)
@@ -0,0 +1,203 @@
+package shard
+
+import (
+	"fmt"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	"github.com/whyrusleeping/sql-datastore"
+	"github.com/whyrusleeping/sql-datastore/internal/testdb"
+	"github.com/whyrusleeping/sql-datastore/postgres"
+)
+
+// Every shard lives in its own test database.
+func newShard(t *testing.T, name string) (*sqlds.Datastore, func()) {
+	db, cleanup := testdb.Open(t, name)
+	return sqlds.NewDatastore(db, postgres.Queries{}), cleanup
+}
+
+func testKeys(n int) []ds.Key {
+	var keys []ds.Key
+	for i := 0; i < n; i++ {
+		keys = append(keys, ds.NewKey(fmt.Sprintf("/key/%04d", i)))
+	}
+	return keys
+}
+
+func TestRingMovesFewKeys(t *testing.T) {
+	before := newRing([]string{"a", "b", "c"})
+	after := newRing([]string{"a", "b", "c", "d"})
+
+	keys := testKeys(10000)
+	moved := 0
+	for _, k := range keys {
+		o := after.owner(k)
+		if o != before.owner(k) {
+			if o != "d" {
+				t.Fatalf("%s moved between existing shards", k)
+			}
+			moved++
+		}
+	}
+
+	// a new shard should take roughly a quarter of the keys
+	if moved < len(keys)/8 || moved > len(keys)/2 {
+		t.Fatalf("unbalanced ring: %d of %d keys moved", moved, len(keys))
+	}
+}
+
+func TestShardedQueryAndRebalance(t *testing.T) {
+	shards := make(map[string]*sqlds.Datastore)
+	for _, name := range []string{"shard0", "shard1", "shard2"} {
+		s, done := newShard(t, name)
+		defer done()
+		shards[name] = s
+	}
+
+	d, err := New(shards)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := testKeys(200)
+	b, err := d.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range keys {
+		if err := b.Put(k, []byte(k.String())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	expectOrdered(t, d, dsq.Query{Prefix: "/key"}, keys)
+	expectOrdered(t, d, dsq.Query{Prefix: "/key", Offset: 10, Limit: 5}, keys[10:15])
+
+	extra, done := newShard(t, "shard3")
+	defer done()
+	if err := d.AddShard("shard3", extra); err != nil {
+		t.Fatal(err)
+	}
+
+	// everything stays readable before the keys are moved
+	for _, k := range keys {
+		if _, err := d.Get(k); err != nil {
+			t.Fatalf("get %s during rebalance: %s", k, err)
+		}
+	}
+
+	moved, err := d.Rebalance(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved == 0 {
+		t.Fatal("expected keys to move to the new shard")
+	}
+
+	for _, k := range keys {
+		owner, prev := d.locate(k)
+		if prev != nil {
+			t.Fatal("rebalance did not finish")
+		}
+		has, err := owner.Has(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !has {
+			t.Fatalf("%s not stored on its owner", k)
+		}
+	}
+
+	expectOrdered(t, d, dsq.Query{Prefix: "/key"}, keys)
+}
+
+func expectOrdered(t *testing.T, d *Datastore, q dsq.Query, expect []ds.Key) {
+	res, err := d.Query(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != len(expect) {
+		t.Fatalf("expected %d entries, got %d", len(expect), len(entries))
+	}
+
+	for i, e := range entries {
+		if e.Key != expect[i].String() {
+			t.Fatalf("entry %d: expected %s, got %s", i, expect[i], e.Key)
+		}
+	}
+}
+
+func TestMoveSkipsDeletedKeys(t *testing.T) {
+	shards := make(map[string]*sqlds.Datastore)
+	for _, name := range []string{"shard0", "shard1", "shard2"} {
+		s, done := newShard(t, name)
+		defer done()
+		shards[name] = s
+	}
+
+	d, err := New(shards)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := testKeys(200)
+	for _, k := range keys {
+		if err := d.Put(k, []byte("old")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	extra, done := newShard(t, "shard3")
+	defer done()
+	if err := d.AddShard("shard3", extra); err != nil {
+		t.Fatal(err)
+	}
+
+	// keys listed for a move, then deleted or rewritten before it runs
+	var deleted, written ds.Key
+	for _, k := range keys {
+		if owner, prev := d.locate(k); prev != nil && owner == extra {
+			if deleted.String() == "" {
+				deleted = k
+			} else {
+				written = k
+				break
+			}
+		}
+	}
+	if written.String() == "" {
+		t.Fatal("expected keys to move to the new shard")
+	}
+
+	_, src := d.locate(deleted)
+	if err := d.Delete(deleted); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put(written, []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.move(src, []ds.Key{deleted, written}); err != nil {
+		t.Fatal(err)
+	}
+
+	if has, _ := d.Has(deleted); has {
+		t.Fatal("move brought back a deleted key")
+	}
+	if val, err := d.Get(written); err != nil || string(val) != "new" {
+		t.Fatal("move overwrote a newer value", err)
+	}
+	if has, _ := src.Has(written); has {
+		t.Fatal("move left the old copy behind")
+	}
+}
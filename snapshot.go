@@ -0,0 +1,403 @@
+package sqlds
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// SnapshotQueries are the statements needed to keep named snapshots on
+// top of the value history of VersionQueries. A snapshot is a point in
+// time; the history keeps the values it needs.
+type SnapshotQueries interface {
+	// LockHistory takes the history lock exclusively until the end of the
+	// transaction, waiting for the writers that share it
+	LockHistory() string
+	// SeedVersions records the current value of every key that has no
+	// version yet, as written at time $1
+	SeedVersions() string
+	// CreateSnapshot inserts snapshot name ($1) taken at the database's
+	// current time
+	CreateSnapshot() string
+	// SnapshotTime selects the time of snapshot $1
+	SnapshotTime() string
+	// ListSnapshots selects name and time of every snapshot, oldest first
+	ListSnapshots() string
+	// DeleteSnapshot deletes snapshot $1
+	DeleteSnapshot() string
+	// OldestSnapshot selects the time of the oldest snapshot, if any
+	OldestSnapshot() string
+	// QueryAt selects key and value of every key that existed at time $1,
+	// and accepts the Prefix, Limit and Offset suffixes
+	QueryAt() string
+}
+
+// ErrSnapshotNotFound is returned for a snapshot name that does not exist
+var ErrSnapshotNotFound = errors.New("sqlds: snapshot not found")
+
+// SnapshotInfo describes a snapshot
+type SnapshotInfo struct {
+	Name string
+	Time time.Time
+}
+
+func (d *Datastore) snapshotQueries() (SnapshotQueries, error) {
+	if d.versions == nil {
+		return nil, errors.New("sqlds: snapshots need versioning to be enabled")
+	}
+
+	if _, err := d.versionQueries(); err != nil {
+		return nil, err
+	}
+
+	sq, ok := d.queries.(SnapshotQueries)
+	if !ok {
+		return nil, fmt.Errorf("sqlds: %T does not support snapshots", d.queries)
+	}
+
+	return sq, nil
+}
+
+// Snapshot records the current state of the datastore under name. Only
+// the first snapshot copies anything: it adds the values of keys written
+// before versioning was enabled to the history. After that, the history
+// kept by WithVersioning is enough, and PruneHistory keeps the versions
+// the oldest snapshot needs. Versioned writes share a lock that the
+// snapshot takes exclusively, so it waits for the transactions in flight to
+// commit and holds back new ones until it is taken: it contains all of a
+// transaction's writes or none of them.
+func (d *Datastore) Snapshot(name string) error {
+	sq, err := d.snapshotQueries()
+	if err != nil {
+		return err
+	}
+
+	if _, err := d.snapshotTime(sq, name); err == nil {
+		return fmt.Errorf("sqlds: snapshot %q exists", name)
+	} else if err != ErrSnapshotNotFound {
+		return err
+	}
+
+	return d.guard(func() error {
+		txn, err := d.db.Begin()
+		if err != nil {
+			return err
+		}
+
+		if _, err := txn.Exec(sq.LockHistory()); err != nil {
+			txn.Rollback()
+			return err
+		}
+
+		if _, err := txn.Exec(sq.SeedVersions(), time.Unix(0, 0).UTC()); err != nil {
+			txn.Rollback()
+			return err
+		}
+
+		if _, err := txn.Exec(sq.CreateSnapshot(), name); err != nil {
+			txn.Rollback()
+			return err
+		}
+
+		return txn.Commit()
+	})
+}
+
+func (d *Datastore) snapshotTime(sq SnapshotQueries, name string) (t time.Time, err error) {
+	err = d.read(func(db *sql.DB) error {
+		switch err := db.QueryRow(sq.SnapshotTime(), name).Scan(&t); err {
+		case sql.ErrNoRows:
+			return ErrSnapshotNotFound
+		default:
+			return err
+		}
+	})
+
+	return t, err
+}
+
+// Snapshots lists the snapshots, oldest first
+func (d *Datastore) Snapshots() ([]SnapshotInfo, error) {
+	sq, err := d.snapshotQueries()
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []SnapshotInfo
+	err = d.read(func(db *sql.DB) error {
+		infos = nil
+
+		rows, err := db.Query(sq.ListSnapshots())
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var info SnapshotInfo
+			if err := rows.Scan(&info.Name, &info.Time); err != nil {
+				return err
+			}
+			infos = append(infos, info)
+		}
+
+		return rows.Err()
+	})
+
+	return infos, err
+}
+
+// DeleteSnapshot removes a snapshot. The versions only it needed are
+// removed by the next PruneHistory.
+func (d *Datastore) DeleteSnapshot(name string) error {
+	sq, err := d.snapshotQueries()
+	if err != nil {
+		return err
+	}
+
+	var result sql.Result
+	err = d.guard(func() (err error) {
+		result, err = d.db.Exec(sq.DeleteSnapshot(), name)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rows == 0 {
+		return ErrSnapshotNotFound
+	}
+
+	return nil
+}
+
+// oldestSnapshot returns the time of the oldest snapshot, if there is one
+func (d *Datastore) oldestSnapshot() (t time.Time, ok bool, err error) {
+	sq, isSnapshotter := d.queries.(SnapshotQueries)
+	if !isSnapshotter {
+		return t, false, nil
+	}
+
+	err = d.guard(func() error {
+		return d.db.QueryRow(sq.OldestSnapshot()).Scan(&t)
+	})
+
+	switch err {
+	case sql.ErrNoRows:
+		return t, false, nil
+	case nil:
+		return t, true, nil
+	default:
+		return t, false, err
+	}
+}
+
+// OpenSnapshot returns a read-only view of the datastore as it was when
+// the snapshot was taken
+func (d *Datastore) OpenSnapshot(name string) (*SnapshotView, error) {
+	sq, err := d.snapshotQueries()
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := d.snapshotTime(sq, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SnapshotView{d: d, sq: sq, name: name, time: t}, nil
+}
+
+// Restore makes the datastore equal to the snapshot again, in one
+// transaction on the primary. Keys added since are deleted and changed
+// ones rewritten; the restore itself is recorded in the history like any
+// other write, so the snapshot and newer ones stay usable. Both states are
+// held in memory while the difference is computed.
+func (d *Datastore) Restore(name string) error {
+	sq, err := d.snapshotQueries()
+	if err != nil {
+		return err
+	}
+
+	b := &batch{ds: d, ctx: context.Background()}
+	txn, err := b.GetTransaction()
+	if err != nil {
+		return err
+	}
+
+	var want, current map[string][]byte
+	err = d.guard(func() error {
+		var t time.Time
+		switch err := txn.QueryRow(sq.SnapshotTime(), name).Scan(&t); err {
+		case nil:
+		case sql.ErrNoRows:
+			return ErrSnapshotNotFound
+		default:
+			return err
+		}
+
+		want, err = readEntries(txn, d.withParams(sq.QueryAt(), dsq.Query{}), t.UTC())
+		if err != nil {
+			return err
+		}
+
+		base, err := d.baseQuery()
+		if err != nil {
+			return err
+		}
+		current, err = readEntries(txn, base)
+		return err
+	})
+	if err != nil {
+		txn.Rollback()
+		return err
+	}
+
+	changed := false
+	for key, value := range current {
+		wanted, ok := want[key]
+		if ok && bytes.Equal(wanted, value) {
+			delete(want, key)
+			continue
+		}
+
+		if !ok {
+			// Delete and Put roll the transaction back if they fail
+			if err := b.Delete(ds.RawKey(key)); err != nil {
+				return err
+			}
+			changed = true
+		}
+	}
+
+	// the keys left are missing or changed; Put replaces the changed
+	// ones, since the datastore is versioned
+	for key, value := range want {
+		if err := b.Put(ds.RawKey(key), value); err != nil {
+			return err
+		}
+		changed = true
+	}
+
+	if !changed {
+		return txn.Rollback()
+	}
+
+	return b.Commit()
+}
+
+// readEntries reads the key and value of every row query selects
+func readEntries(txn *sql.Tx, query string, args ...interface{}) (map[string][]byte, error) {
+	rows, err := txn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make(map[string][]byte)
+	for rows.Next() {
+		var key string
+		var value []byte
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+		if value == nil {
+			value = []byte{}
+		}
+		entries[key] = value
+	}
+
+	return entries, rows.Err()
+}
+
+// SnapshotView is a read-only view of a snapshot
+type SnapshotView struct {
+	d    *Datastore
+	sq   SnapshotQueries
+	name string
+	time time.Time
+}
+
+// Name returns the name of the snapshot
+func (v *SnapshotView) Name() string {
+	return v.name
+}
+
+// Time returns when the snapshot was taken
+func (v *SnapshotView) Time() time.Time {
+	return v.time
+}
+
+func (v *SnapshotView) Get(key ds.Key) ([]byte, error) {
+	return v.d.GetAt(key, v.time)
+}
+
+func (v *SnapshotView) Has(key ds.Key) (bool, error) {
+	_, err := v.Get(key)
+	switch err {
+	case nil:
+		return true, nil
+	case ds.ErrNotFound:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+func (v *SnapshotView) GetSize(key ds.Key) (int, error) {
+	value, err := v.Get(key)
+	if err != nil {
+		return -1, err
+	}
+
+	return len(value), nil
+}
+
+func (v *SnapshotView) Query(q dsq.Query) (dsq.Results, error) {
+	var entries []dsq.Entry
+	err := v.d.read(func(db *sql.DB) error {
+		entries = nil
+
+		rows, err := db.Query(v.d.withParams(v.sq.QueryAt(), q), v.time.UTC())
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var e dsq.Entry
+			if err := rows.Scan(&e.Key, &e.Value); err != nil {
+				return err
+			}
+			if e.Value == nil {
+				e.Value = []byte{}
+			}
+			entries = append(entries, e)
+		}
+
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var res dsq.Results = dsq.ResultsWithEntries(q, entries)
+	for _, f := range q.Filters {
+		res = dsq.NaiveFilter(res, f)
+	}
+
+	return dsq.NaiveOrder(res, q.Orders...), nil
+}
+
+var _ ds.Read = (*SnapshotView)(nil)
@@ -0,0 +1,221 @@
+package sqlds_test
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	sqlds "github.com/whyrusleeping/sql-datastore"
+	"github.com/whyrusleeping/sql-datastore/internal/testdb"
+	"github.com/whyrusleeping/sql-datastore/postgres"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	// written before versioning, so only the snapshot records them
+	if err := d.Put(ds.NewKey("/pins/a"), []byte("a1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put(ds.NewKey("/pins/b"), []byte("b1")); err != nil {
+		t.Fatal(err)
+	}
+
+	d = sqlds.NewDatastore(d.DB(), postgres.Queries{}, sqlds.WithVersioning(sqlds.VersionConfig{}))
+	if err := d.Put(ds.NewKey("/pins/c"), []byte("c1")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	if err := d.Snapshot("before"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Snapshot("before"); err == nil {
+		t.Fatal("expected an error for a duplicate snapshot name")
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	// the risky migration
+	if err := d.Delete(ds.NewKey("/pins/a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete(ds.NewKey("/pins/c")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put(ds.NewKey("/pins/c"), []byte("c2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put(ds.NewKey("/pins/d"), []byte("d1")); err != nil {
+		t.Fatal(err)
+	}
+
+	view, err := d.OpenSnapshot("before")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"/pins/a": "a1", "/pins/b": "b1", "/pins/c": "c1"}
+	checkView := func(r ds.Read) {
+		res, err := r.Query(dsq.Query{Prefix: "/pins"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := res.Rest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != len(want) {
+			t.Fatalf("expected %d entries, got %v", len(want), entries)
+		}
+		for _, e := range entries {
+			if string(e.Value) != want[e.Key] {
+				t.Fatalf("expected %s for %s, got %s", want[e.Key], e.Key, e.Value)
+			}
+		}
+	}
+	checkView(view)
+
+	if has, err := view.Has(ds.NewKey("/pins/d")); err != nil || has {
+		t.Fatal("the snapshot sees a key added after it", err)
+	}
+
+	// pruning keeps what the snapshot needs
+	if _, err := d.PruneHistory(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Restore("before"); err != nil {
+		t.Fatal(err)
+	}
+	checkView(d)
+
+	infos, err := d.Snapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].Name != "before" || !infos[0].Time.Equal(view.Time()) {
+		t.Fatalf("unexpected snapshots: %+v", infos)
+	}
+
+	if err := d.DeleteSnapshot("before"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.OpenSnapshot("before"); err != sqlds.ErrSnapshotNotFound {
+		t.Fatal("expected ErrSnapshotNotFound, got", err)
+	}
+}
+
+func TestRestoreReadsPrimary(t *testing.T) {
+	p, done := newDS(t)
+	defer done()
+	replica, rdone := newLaggingReplica(t)
+	defer rdone()
+
+	d := sqlds.NewDatastoreWithReplicas(p.DB(), []*sql.DB{replica}, postgres.Queries{}, sqlds.WithVersioning(sqlds.VersionConfig{}))
+	if err := d.Put(ds.NewKey("/pins/a"), []byte("a1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Snapshot("before"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if err := d.Put(ds.NewKey("/pins/b"), []byte("b1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the replica has replicated nothing yet, not even the snapshot
+	if err := d.Restore("before"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.Get(ds.NewKey("/pins/b")); err != ds.ErrNotFound {
+		t.Fatal("expected the key added after the snapshot to be removed, got", err)
+	}
+	if got, err := p.Get(ds.NewKey("/pins/a")); err != nil || string(got) != "a1" {
+		t.Fatal("restore lost the snapshot's key", err)
+	}
+}
+
+func TestSnapshotWaitsForWrites(t *testing.T) {
+	testdb.RequirePostgres(t)
+
+	d, done := newDS(t, sqlds.WithVersioning(sqlds.VersionConfig{}))
+	defer done()
+
+	b, err := d.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put(ds.NewKey("/a"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	taken := make(chan error, 1)
+	go func() {
+		taken <- d.Snapshot("mid-batch")
+	}()
+
+	select {
+	case err := <-taken:
+		t.Fatal("snapshot taken while a batch was in flight:", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := b.Put(ds.NewKey("/b"), []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-taken; err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := d.OpenSnapshot("mid-batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"/a", "/b"} {
+		if _, err := v.Get(ds.NewKey(key)); err != nil {
+			t.Fatalf("snapshot is missing %s of the batch: %v", key, err)
+		}
+	}
+}
+
+func TestSnapshotQueryOrders(t *testing.T) {
+	d, done := newDS(t, sqlds.WithVersioning(sqlds.VersionConfig{}))
+	defer done()
+
+	for key, value := range map[string]string{"/a": "1", "/b": "2", "/c": "1"} {
+		if err := d.Put(ds.NewKey(key), []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Snapshot("s"); err != nil {
+		t.Fatal(err)
+	}
+	v, err := d.OpenSnapshot("s")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// by value, then by key descending among equal values
+	res, err := v.Query(dsq.Query{Orders: []dsq.Order{dsq.OrderByValue{}, dsq.OrderByKeyDescending{}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	for _, e := range entries {
+		keys = append(keys, e.Key)
+	}
+	if len(keys) != 3 || keys[0] != "/c" || keys[1] != "/a" || keys[2] != "/b" {
+		t.Fatalf("unexpected order %v", keys)
+	}
+}
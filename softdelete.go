@@ -0,0 +1,240 @@
+package sqlds
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// SoftDeleteQueries are the statements needed to keep deleted rows as
+// tombstones. A tombstone is the deleted row moved to a table of its own
+// with the time of the deletion, so reads never see it.
+type SoftDeleteQueries interface {
+	// Tombstone copies the row of key ($1) to the tombstones, deleted at
+	// the time of the database clock
+	Tombstone() string
+	// LatestTombstone selects sequence number and data of the newest
+	// tombstone of key ($1)
+	LatestTombstone() string
+	// Undelete inserts key ($1) back from tombstone $2, unless the key
+	// exists
+	Undelete() string
+	// DropTombstone deletes tombstone $1
+	DropTombstone() string
+	// PurgeTombstones deletes the tombstones of rows deleted before $1
+	PurgeTombstones() string
+}
+
+// ErrUndeleteConflict is returned by Undelete when the key has been
+// written again since it was deleted
+var ErrUndeleteConflict = errors.New("sqlds: key was written again since it was deleted")
+
+// SoftDeleteConfig configures soft deletes
+type SoftDeleteConfig struct {
+	// GracePeriod is how long deleted rows can be restored with Undelete.
+	// Zero keeps them until PurgeDeleted is called.
+	GracePeriod time.Duration
+	// PurgeInterval is how often rows deleted longer than GracePeriod ago
+	// are removed in the background
+	PurgeInterval time.Duration
+}
+
+// DefaultSoftDeleteConfig keeps deleted rows for a week
+var DefaultSoftDeleteConfig = SoftDeleteConfig{
+	GracePeriod:   7 * 24 * time.Hour,
+	PurgeInterval: time.Hour,
+}
+
+type softDelete struct {
+	cfg  SoftDeleteConfig
+	stop chan struct{}
+}
+
+// WithSoftDelete makes Delete, in batches too, move rows to a tombstone
+// table instead of removing them, so that they can be brought back with
+// Undelete until they are purged. It cannot be combined with WithDedup or
+// WithChunking, and the Datastore's Queries must implement
+// SoftDeleteQueries.
+func WithSoftDelete(cfg SoftDeleteConfig) Option {
+	return func(d *Datastore) {
+		d.softDelete = &softDelete{cfg: cfg, stop: make(chan struct{})}
+	}
+}
+
+func (s *softDelete) start(d *Datastore) {
+	if s.cfg.GracePeriod <= 0 || s.cfg.PurgeInterval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(s.cfg.PurgeInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				_, err := d.PurgeDeleted(time.Now().Add(-s.cfg.GracePeriod))
+				if err != nil {
+					log.Printf("sqlds: purging deleted rows: %s", err)
+				}
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (s *softDelete) close() {
+	close(s.stop)
+}
+
+func (d *Datastore) softDeleteQueries() (SoftDeleteQueries, error) {
+	if d.invalid != nil {
+		return nil, d.invalid
+	}
+
+	sq, ok := d.queries.(SoftDeleteQueries)
+	if !ok {
+		return nil, fmt.Errorf("sqlds: %T does not support soft delete", d.queries)
+	}
+
+	return sq, nil
+}
+
+func (d *Datastore) deleteSoft(e execer, key ds.Key) (sql.Result, error) {
+	sq, err := d.softDeleteQueries()
+	if err != nil {
+		return nil, err
+	}
+
+	// UTC, so that times compare correctly where they are stored as text
+	if _, err := e.Exec(sq.Tombstone(), key.String()); err != nil {
+		return nil, err
+	}
+
+	return e.Exec(d.queries.Delete(), key.String())
+}
+
+// Undelete restores the value key had when it was last deleted. It returns
+// ds.ErrNotFound if there is no deleted value to restore, and
+// ErrUndeleteConflict if the key has been written again since.
+func (d *Datastore) Undelete(key ds.Key) error {
+	return d.undeleteContext(context.Background(), key)
+}
+
+func (d *Datastore) undeleteContext(ctx context.Context, key ds.Key) error {
+	sq, err := d.softDeleteQueries()
+	if err != nil {
+		return err
+	}
+
+	if d.cache != nil {
+		defer d.cache.invalidate(key)
+	}
+
+	if d.bloom != nil {
+		d.bloom.add(key)
+		defer d.bloom.add(key)
+	}
+
+	var ev AuditEvent
+	err = d.guard(func() error {
+		return d.write(func(e execer) error {
+			size, err := d.undelete(e, sq, key)
+			if err != nil || d.audit == nil {
+				return err
+			}
+
+			ev = d.auditEvent(ctx, AuditUndelete, key, int64(size))
+			return d.recordAudit(e, ev)
+		})
+	})
+
+	if err == nil {
+		d.emitAudit(ev)
+	}
+
+	return err
+}
+
+// undelete restores key and returns the size of its stored value
+func (d *Datastore) undelete(e execer, sq SoftDeleteQueries, key ds.Key) (int, error) {
+	var seq int64
+	var value []byte
+	switch err := e.QueryRow(sq.LatestTombstone(), key.String()).Scan(&seq, &value); err {
+	case sql.ErrNoRows:
+		return 0, ds.ErrNotFound
+	case nil:
+	default:
+		return 0, err
+	}
+
+	result, err := e.Exec(sq.Undelete(), key.String(), seq)
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if rows == 0 {
+		return 0, ErrUndeleteConflict
+	}
+
+	if _, err := e.Exec(sq.DropTombstone(), seq); err != nil {
+		return 0, err
+	}
+
+	if value == nil {
+		value = []byte{}
+	}
+	if err := d.recordVersion(e, key, value, result); err != nil {
+		return 0, err
+	}
+
+	return len(value), d.logChange(e, ChangePut, key, result)
+}
+
+// PurgeDeleted removes the rows deleted before before for good, and
+// returns how many were removed
+func (d *Datastore) PurgeDeleted(before time.Time) (int64, error) {
+	return d.purgeDeletedContext(context.Background(), before)
+}
+
+func (d *Datastore) purgeDeletedContext(ctx context.Context, before time.Time) (int64, error) {
+	sq, err := d.softDeleteQueries()
+	if err != nil {
+		return 0, err
+	}
+
+	var removed int64
+	var ev AuditEvent
+	err = d.guard(func() error {
+		return d.write(func(e execer) error {
+			result, err := e.Exec(sq.PurgeTombstones(), before.UTC())
+			if err != nil {
+				return err
+			}
+
+			removed, err = result.RowsAffected()
+			if err != nil || removed == 0 || d.audit == nil {
+				return err
+			}
+
+			ev = d.auditEvent(ctx, AuditPurge, ds.Key{}, removed)
+			return d.recordAudit(e, ev)
+		})
+	})
+
+	if err == nil && removed > 0 {
+		d.emitAudit(ev)
+	}
+
+	return removed, err
+}
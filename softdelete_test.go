@@ -0,0 +1,89 @@
+package sqlds_test
+
+import (
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	sqlds "github.com/whyrusleeping/sql-datastore"
+)
+
+func TestSoftDelete(t *testing.T) {
+	d, done := newDS(t, sqlds.WithSoftDelete(sqlds.SoftDeleteConfig{}))
+	defer done()
+
+	root := ds.NewKey("/pins/root")
+	if err := d.Put(root, []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put(ds.NewKey("/pins/other"), []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Delete(root); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete(root); err != ds.ErrNotFound {
+		t.Fatal("expected ErrNotFound deleting twice, got", err)
+	}
+
+	if _, err := d.Get(root); err != ds.ErrNotFound {
+		t.Fatal("a deleted key is still readable:", err)
+	}
+	res, err := d.Query(dsq.Query{Prefix: "/pins"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Key != "/pins/other" {
+		t.Fatalf("a deleted key is still listed: %v", entries)
+	}
+
+	if err := d.Undelete(root); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := d.Get(root); err != nil || string(val) != "v1" {
+		t.Fatal("undelete did not restore the value", err)
+	}
+	if err := d.Undelete(root); err != ds.ErrNotFound {
+		t.Fatal("expected ErrNotFound with nothing to restore, got", err)
+	}
+
+	// a key written again after the delete wins
+	if err := d.Delete(root); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put(root, []byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Undelete(root); err != sqlds.ErrUndeleteConflict {
+		t.Fatal("expected ErrUndeleteConflict, got", err)
+	}
+
+	b, err := d.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Delete(root); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	purged, err := d.PurgeDeleted(time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the tombstones of v1, left behind by the conflict, and of v2
+	if purged != 2 {
+		t.Fatalf("expected 2 tombstones purged, got %d", purged)
+	}
+	if err := d.Undelete(root); err != ds.ErrNotFound {
+		t.Fatal("expected a purged key to be gone, got", err)
+	}
+}
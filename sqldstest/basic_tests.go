@@ -0,0 +1,537 @@
+package sqldstest
+
+import (
+	"strings"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	"github.com/whyrusleeping/sql-datastore"
+)
+
+// Testcases are the keys and values AddTestCases writes
+var Testcases = map[string]string{
+	"/a":     "a",
+	"/a/b":   "ab",
+	"/a/b/c": "abc",
+	"/a/b/d": "a/b/d",
+	"/a/c":   "ac",
+	"/a/d":   "ad",
+	"/e":     "e",
+	"/f":     "f",
+	"/g":     "",
+}
+
+// AddTestCases puts testcases into d, checks that a nil value is refused,
+// and reads every value back.
+func AddTestCases(t *testing.T, d *sqlds.Datastore, testcases map[string]string) {
+	for k, v := range testcases {
+		dsk := ds.NewKey(k)
+		if err := d.Put(dsk, []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := d.Put(ds.NewKey("/foo"), nil)
+	if err != ds.ErrInvalidType {
+		t.Error("Expected err to be ds.ErrInvalidType")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for k, v := range testcases {
+		dsk := ds.NewKey(k)
+		v2, err := d.Get(dsk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v2b := v2
+		if string(v2b) != v {
+			t.Errorf("%s values differ: %s != %s", k, v, v2)
+		}
+	}
+}
+
+func SubtestQuery(t *testing.T, dl Dialect) {
+	d, done := dl.Datastore(t)
+	defer done()
+
+	AddTestCases(t, d, Testcases)
+
+	// test prefix
+	rs, err := d.Query(dsq.Query{Prefix: "/a/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectMatches(t, []string{
+		"/a/b",
+		"/a/b/c",
+		"/a/b/d",
+		"/a/c",
+		"/a/d",
+	}, rs)
+
+	// test offset and limit
+	rs, err = d.Query(dsq.Query{Prefix: "/a/", Offset: 2, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectMatches(t, []string{
+		"/a/b/d",
+		"/a/c",
+	}, rs)
+
+	// test orders
+	orbk := dsq.OrderByKey{}
+	orderByKey := []dsq.Order{orbk}
+	rs, err = d.Query(dsq.Query{Prefix: "/a/", Orders: orderByKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectKeyOrderMatches(t, rs, []string{
+		"/a/b",
+		"/a/b/c",
+		"/a/b/d",
+		"/a/c",
+		"/a/d",
+	})
+
+	orbkd := dsq.OrderByKeyDescending{}
+	orderByDesc := []dsq.Order{orbkd}
+	rs, err = d.Query(dsq.Query{Prefix: "/a/", Orders: orderByDesc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectKeyOrderMatches(t, rs, []string{
+		"/a/d",
+		"/a/c",
+		"/a/b/d",
+		"/a/b/c",
+		"/a/b",
+	})
+
+	// later orders break the ties of earlier ones
+	byLength := dsq.OrderByFunction(func(a, b dsq.Entry) int {
+		switch {
+		case len(a.Value) < len(b.Value):
+			return -1
+		case len(a.Value) > len(b.Value):
+			return 1
+		default:
+			return 0
+		}
+	})
+	rs, err = d.Query(dsq.Query{Prefix: "/a/", Orders: []dsq.Order{byLength, orbkd}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectKeyOrderMatches(t, rs, []string{
+		"/a/d",
+		"/a/c",
+		"/a/b",
+		"/a/b/c",
+		"/a/b/d",
+	})
+
+	// test filters
+	equalFilter := dsq.FilterKeyCompare{Op: dsq.Equal, Key: "/a/b"}
+	equalFilters := []dsq.Filter{equalFilter}
+	rs, err = d.Query(dsq.Query{Prefix: "/a/", Filters: equalFilters})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectKeyFilterMatches(t, rs, []string{"/a/b"})
+
+	greaterThanFilter := dsq.FilterKeyCompare{Op: dsq.GreaterThan, Key: "/a/b"}
+	greaterThanFilters := []dsq.Filter{greaterThanFilter}
+	rs, err = d.Query(dsq.Query{Prefix: "/a/", Filters: greaterThanFilters})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectKeyFilterMatches(t, rs, []string{
+		"/a/b/c",
+		"/a/b/d",
+		"/a/c",
+		"/a/d",
+	})
+
+	lessThanFilter := dsq.FilterKeyCompare{Op: dsq.LessThanOrEqual, Key: "/a/b/c"}
+	lessThanFilters := []dsq.Filter{lessThanFilter}
+	rs, err = d.Query(dsq.Query{Prefix: "/a/", Filters: lessThanFilters})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectKeyFilterMatches(t, rs, []string{
+		"/a/b",
+		"/a/b/c",
+	})
+}
+
+func SubtestHas(t *testing.T, dl Dialect) {
+	d, done := dl.Datastore(t)
+	defer done()
+	AddTestCases(t, d, Testcases)
+
+	has, err := d.Has(ds.NewKey("/a/b/c"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	if !has {
+		t.Error("Key should be found")
+	}
+
+	has, err = d.Has(ds.NewKey("/a/b/c/d"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	if has {
+		t.Error("Key should not be found")
+	}
+}
+
+func SubtestNotExistGet(t *testing.T, dl Dialect) {
+	d, done := dl.Datastore(t)
+	defer done()
+	AddTestCases(t, d, Testcases)
+
+	has, err := d.Has(ds.NewKey("/a/b/c/d"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	if has {
+		t.Error("Key should not be found")
+	}
+
+	val, err := d.Get(ds.NewKey("/a/b/c/d"))
+	if val != nil {
+		t.Error("Key should not be found")
+	}
+
+	if err != ds.ErrNotFound {
+		t.Error("Error was not set to ds.ErrNotFound")
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func SubtestDelete(t *testing.T, dl Dialect) {
+	d, done := dl.Datastore(t)
+	defer done()
+	AddTestCases(t, d, Testcases)
+
+	has, err := d.Has(ds.NewKey("/a/b/c"))
+	if err != nil {
+		t.Error(err)
+	}
+	if !has {
+		t.Error("Key should be found")
+	}
+
+	err = d.Delete(ds.NewKey("/a/b/c"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	has, err = d.Has(ds.NewKey("/a/b/c"))
+	if err != nil {
+		t.Error(err)
+	}
+	if has {
+		t.Error("Key should not be found")
+	}
+}
+
+func SubtestGetEmpty(t *testing.T, dl Dialect) {
+	d, done := dl.Datastore(t)
+	defer done()
+
+	err := d.Put(ds.NewKey("/a"), []byte{})
+	if err != nil {
+		t.Error(err)
+	}
+
+	v, err := d.Get(ds.NewKey("/a"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(v) != 0 {
+		t.Error("expected 0 len []byte form get")
+	}
+}
+
+func SubtestBatching(t *testing.T, dl Dialect) {
+	d, done := dl.Datastore(t)
+	defer done()
+
+	b, err := d.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for k, v := range Testcases {
+		err := b.Put(ds.NewKey(k), []byte(v))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = b.Put(ds.NewKey("/foo"), nil)
+	if err != ds.ErrInvalidType {
+		t.Error("Expected err to be ds.ErrInvalidType")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = b.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for k, v := range Testcases {
+		val, err := d.Get(ds.NewKey(k))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if v != string(val) {
+			t.Fatal("got wrong data!")
+		}
+	}
+
+	//Test delete
+	b, err = d.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = b.Delete(ds.NewKey("/a/b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = b.Delete(ds.NewKey("/a/b/c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = b.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rs, err := d.Query(dsq.Query{Prefix: "/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectMatches(t, []string{
+		"/a",
+		"/a/b/d",
+		"/a/c",
+		"/a/d",
+		"/e",
+		"/f",
+		"/g",
+	}, rs)
+}
+
+func SubtestGetSize(t *testing.T, dl Dialect) {
+	d, done := dl.Datastore(t)
+	defer done()
+
+	values := map[string][]byte{
+		"/empty":  {},
+		"/short":  []byte("abc"),
+		"/binary": {0, 0xff, 0, 'x', 0x80},
+		"/long":   make([]byte, 1<<16),
+	}
+
+	for k, v := range values {
+		if err := d.Put(ds.NewKey(k), v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for k, v := range values {
+		size, err := d.GetSize(ds.NewKey(k))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != len(v) {
+			t.Errorf("%s: expected size %d, got %d", k, len(v), size)
+		}
+	}
+
+	size, err := d.GetSize(ds.NewKey("/missing"))
+	if err != ds.ErrNotFound {
+		t.Fatal("expected ErrNotFound for a missing key, got: ", err)
+	}
+	if size != -1 {
+		t.Fatal("expected missing size to be -1")
+	}
+}
+
+// failingQueries breaks every Put after the first few
+type failingQueries struct {
+	sqlds.Queries
+	puts int
+}
+
+func (q *failingQueries) Put() string {
+	q.puts++
+	if q.puts > 3 {
+		return "INSERT INTO no_such_table VALUES (1)"
+	}
+	return q.Queries.Put()
+}
+
+func SubtestBatchFailure(t *testing.T, dl Dialect) {
+	db, cleanup := dl.Open(t)
+	defer cleanup()
+
+	d := sqlds.NewDatastore(db, dl.Queries, dl.Options...)
+	failing := sqlds.NewDatastore(db, &failingQueries{Queries: dl.Queries})
+
+	b, err := failing.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []ds.Key{ds.NewKey("/a"), ds.NewKey("/b"), ds.NewKey("/c")}
+	for _, k := range keys {
+		if err := b.Put(k, []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := b.Put(ds.NewKey("/d"), []byte("value")); err == nil {
+		t.Fatal("expected the broken put to fail")
+	}
+
+	if err := b.Commit(); err == nil {
+		t.Fatal("expected commit of a failed batch to fail")
+	}
+
+	for _, k := range keys {
+		has, err := d.Has(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if has {
+			t.Fatalf("%s from a failed batch was written", k)
+		}
+	}
+
+	// the datastore is still usable afterwards
+	if err := d.Put(ds.NewKey("/after"), []byte("ok")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func SubtestPrefixEscaping(t *testing.T, dl Dialect) {
+	d, done := dl.Datastore(t)
+	defer done()
+
+	keys := []string{
+		"/100%/a",
+		"/100x/a",
+		"/a_b/c",
+		"/axb/c",
+		"/it's/a",
+		`/back\slash/a`,
+		"/backxslash/a",
+	}
+	for _, k := range keys {
+		if err := d.Put(ds.RawKey(k), []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		prefix string
+		expect []string
+	}{
+		{"/100%/", []string{"/100%/a"}},
+		{"/a_b/", []string{"/a_b/c"}},
+		{"/it's/", []string{"/it's/a"}},
+		{`/back\`, []string{`/back\slash/a`}},
+		{"/A", nil},
+	} {
+		rs, err := d.Query(dsq.Query{Prefix: tc.prefix})
+		if err != nil {
+			t.Fatalf("prefix %q: %s", tc.prefix, err)
+		}
+		expectKeyOrderMatches(t, rs, tc.expect)
+	}
+}
+
+func expectMatches(t *testing.T, expect []string, actualR dsq.Results) {
+	actual, err := actualR.Rest()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(actual) != len(expect) {
+		t.Error("not enough", expect, actual)
+	}
+	for _, k := range expect {
+		found := false
+		for _, e := range actual {
+			if e.Key == k {
+				found = true
+			}
+		}
+		if !found {
+			t.Error(k, "not found")
+		}
+	}
+}
+
+func expectKeyOrderMatches(t *testing.T, actual dsq.Results, expect []string) {
+	rs, err := actual.Rest()
+	if err != nil {
+		t.Error("error fetching dsq.Results", expect, actual)
+		return
+	}
+
+	if len(rs) != len(expect) {
+		t.Error("expect != actual.", expect, actual)
+		return
+	}
+
+	for i, r := range rs {
+		if r.Key != expect[i] {
+			t.Error("expect != actual.", expect, actual)
+			return
+		}
+	}
+}
+
+func expectKeyFilterMatches(t *testing.T, actual dsq.Results, expect []string) {
+	actualE, err := actual.Rest()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	actualS := make([]string, len(actualE))
+	for i, e := range actualE {
+		actualS[i] = e.Key
+	}
+
+	if len(actualS) != len(expect) {
+		t.Error("length doesn't match.", expect, actualS)
+		return
+	}
+
+	if strings.Join(actualS, "") != strings.Join(expect, "") {
+		t.Error("expect != actual.", expect, actualS)
+		return
+	}
+}
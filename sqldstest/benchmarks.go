@@ -0,0 +1,217 @@
+package sqldstest
+
+import (
+	"crypto/rand"
+	"fmt"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	"github.com/whyrusleeping/sql-datastore"
+)
+
+// Parameters of BenchmarkAll. Override them before running to compare other
+// configurations.
+var (
+	// BenchValueSizes are the value sizes, in bytes, every benchmark runs with
+	BenchValueSizes = []int{64, 4 << 10, 64 << 10}
+	// BenchKeyCounts are the numbers of keys read and queried from
+	BenchKeyCounts = []int{100, 1000}
+	// BenchBatchSizes are the numbers of puts per batch commit
+	BenchBatchSizes = []int{1, 16, 256}
+)
+
+func benchKey(i int) ds.Key {
+	return ds.NewKey(fmt.Sprintf("/bench/%08d", i))
+}
+
+func benchValue(size int) []byte {
+	v := make([]byte, size)
+	rand.Read(v)
+	return v
+}
+
+// fill puts n keys of size bytes each through a single batch
+func fill(b *testing.B, d *sqlds.Datastore, n, size int) {
+	value := benchValue(size)
+	batch, err := d.Batch()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for i := 0; i < n; i++ {
+		if err := batch.Put(benchKey(i), value); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	if err := batch.Commit(); err != nil {
+		b.Fatal(err)
+	}
+}
+
+// reportRows adds a rows/s metric for rows processed since start
+func reportRows(b *testing.B, rows int, start time.Time) {
+	if elapsed := time.Since(start).Seconds(); elapsed > 0 {
+		b.ReportMetric(float64(rows)/elapsed, "rows/s")
+	}
+}
+
+// BenchmarkAll runs every benchmark against the dialect, each on a fresh
+// database
+func BenchmarkAll(b *testing.B, dl Dialect) {
+	b.Run("Put", func(b *testing.B) { BenchmarkPut(b, dl) })
+	b.Run("Get", func(b *testing.B) { BenchmarkGet(b, dl) })
+	b.Run("Has", func(b *testing.B) { BenchmarkHas(b, dl) })
+	b.Run("GetSize", func(b *testing.B) { BenchmarkGetSize(b, dl) })
+	b.Run("Batch", func(b *testing.B) { BenchmarkBatch(b, dl) })
+	b.Run("Query", func(b *testing.B) { BenchmarkQuery(b, dl) })
+}
+
+func BenchmarkPut(b *testing.B, dl Dialect) {
+	for _, size := range BenchValueSizes {
+		b.Run(fmt.Sprintf("value=%d", size), func(b *testing.B) {
+			d, done := dl.Datastore(b)
+			defer done()
+
+			value := benchValue(size)
+			b.SetBytes(int64(size))
+			b.ResetTimer()
+			start := time.Now()
+
+			for i := 0; i < b.N; i++ {
+				if err := d.Put(benchKey(i), value); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			reportRows(b, b.N, start)
+		})
+	}
+}
+
+// benchRead runs read against keys of a table holding count values. Only
+// reads that return the value report bytes/op.
+func benchRead(b *testing.B, dl Dialect, values bool, read func(d *sqlds.Datastore, key ds.Key) error) {
+	for _, count := range BenchKeyCounts {
+		for _, size := range BenchValueSizes {
+			b.Run(fmt.Sprintf("keys=%d/value=%d", count, size), func(b *testing.B) {
+				d, done := dl.Datastore(b)
+				defer done()
+
+				fill(b, d, count, size)
+				if values {
+					b.SetBytes(int64(size))
+				}
+				b.ResetTimer()
+				start := time.Now()
+
+				for i := 0; i < b.N; i++ {
+					if err := read(d, benchKey(i%count)); err != nil {
+						b.Fatal(err)
+					}
+				}
+
+				reportRows(b, b.N, start)
+			})
+		}
+	}
+}
+
+func BenchmarkGet(b *testing.B, dl Dialect) {
+	benchRead(b, dl, true, func(d *sqlds.Datastore, key ds.Key) error {
+		_, err := d.Get(key)
+		return err
+	})
+}
+
+func BenchmarkHas(b *testing.B, dl Dialect) {
+	benchRead(b, dl, false, func(d *sqlds.Datastore, key ds.Key) error {
+		has, err := d.Has(key)
+		if err == nil && !has {
+			err = ds.ErrNotFound
+		}
+		return err
+	})
+}
+
+func BenchmarkGetSize(b *testing.B, dl Dialect) {
+	benchRead(b, dl, false, func(d *sqlds.Datastore, key ds.Key) error {
+		_, err := d.GetSize(key)
+		return err
+	})
+}
+
+func BenchmarkBatch(b *testing.B, dl Dialect) {
+	for _, batchSize := range BenchBatchSizes {
+		for _, size := range BenchValueSizes {
+			b.Run(fmt.Sprintf("batch=%d/value=%d", batchSize, size), func(b *testing.B) {
+				d, done := dl.Datastore(b)
+				defer done()
+
+				value := benchValue(size)
+				b.SetBytes(int64(batchSize * size))
+				b.ResetTimer()
+				start := time.Now()
+
+				for i := 0; i < b.N; i++ {
+					batch, err := d.Batch()
+					if err != nil {
+						b.Fatal(err)
+					}
+
+					for j := 0; j < batchSize; j++ {
+						if err := batch.Put(benchKey(i*batchSize+j), value); err != nil {
+							b.Fatal(err)
+						}
+					}
+
+					if err := batch.Commit(); err != nil {
+						b.Fatal(err)
+					}
+				}
+
+				reportRows(b, b.N*batchSize, start)
+			})
+		}
+	}
+}
+
+func BenchmarkQuery(b *testing.B, dl Dialect) {
+	for _, keysOnly := range []bool{false, true} {
+		for _, count := range BenchKeyCounts {
+			for _, size := range BenchValueSizes {
+				name := fmt.Sprintf("keysonly=%t/keys=%d/value=%d", keysOnly, count, size)
+				b.Run(name, func(b *testing.B) {
+					d, done := dl.Datastore(b)
+					defer done()
+
+					fill(b, d, count, size)
+					if !keysOnly {
+						b.SetBytes(int64(count * size))
+					}
+					b.ResetTimer()
+					start := time.Now()
+
+					for i := 0; i < b.N; i++ {
+						res, err := d.Query(dsq.Query{Prefix: "/bench/", KeysOnly: keysOnly})
+						if err != nil {
+							b.Fatal(err)
+						}
+
+						rows, err := res.Rest()
+						if err != nil {
+							b.Fatal(err)
+						}
+						if len(rows) != count {
+							b.Fatalf("expected %d rows, got %d", count, len(rows))
+						}
+					}
+
+					reportRows(b, b.N*count, start)
+				})
+			}
+		}
+	}
+}
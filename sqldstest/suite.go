@@ -0,0 +1,73 @@
+// Package sqldstest holds tests every Queries implementation should pass,
+// in the spirit of go-datastore's dstest. Dialect packages run SubtestAll
+// from their own tests.
+package sqldstest
+
+import (
+	"database/sql"
+	"reflect"
+	"runtime"
+	"testing"
+
+	dstest "github.com/ipfs/go-datastore/test"
+	"github.com/whyrusleeping/sql-datastore"
+)
+
+// Dialect is a Queries implementation under test
+type Dialect struct {
+	Queries sqlds.Queries
+	// Open returns an empty database with the tables Queries expects, and
+	// a function that drops it again
+	Open func(t testing.TB) (*sql.DB, func())
+	// Options are passed to every Datastore, e.g. to run the suite with
+	// an optional storage mode enabled
+	Options []sqlds.Option
+}
+
+// Datastore opens a fresh database and returns a Datastore over it, built
+// with the dialect's Options followed by opts, and a function to call on
+// exit.
+func (dl Dialect) Datastore(t testing.TB, opts ...sqlds.Option) (*sqlds.Datastore, func()) {
+	db, cleanup := dl.Open(t)
+	options := append(append([]sqlds.Option(nil), dl.Options...), opts...)
+	d := sqlds.NewDatastore(db, dl.Queries, options...)
+	return d, func() {
+		d.Close()
+		cleanup()
+	}
+}
+
+// Subtests is a list of the sqlds specific tests, each of which runs
+// against a fresh database.
+var Subtests = []func(t *testing.T, dl Dialect){
+	SubtestQuery,
+	SubtestHas,
+	SubtestNotExistGet,
+	SubtestDelete,
+	SubtestGetEmpty,
+	SubtestGetSize,
+	SubtestBatching,
+	SubtestBatchFailure,
+	SubtestPrefixEscaping,
+}
+
+func getFunctionName(i interface{}) string {
+	return runtime.FuncForPC(reflect.ValueOf(i).Pointer()).Name()
+}
+
+// SubtestAll runs the go-datastore conformance suite and Subtests against
+// the dialect.
+func SubtestAll(t *testing.T, dl Dialect) {
+	t.Run("dstest", func(t *testing.T) {
+		d, done := dl.Datastore(t)
+		defer done()
+
+		dstest.SubtestAll(t, d)
+	})
+
+	for _, f := range Subtests {
+		t.Run(getFunctionName(f), func(t *testing.T) {
+			f(t, dl)
+		})
+	}
+}
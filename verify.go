@@ -0,0 +1,215 @@
+package sqlds
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base32"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+	"sync/atomic"
+
+	ds "github.com/ipfs/go-datastore"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// BlocksPrefix is the namespace go-ipfs stores blocks under. Keys below it
+// are the unpadded base32 encoding of the block's multihash.
+var BlocksPrefix = ds.NewKey("/blocks")
+
+var keyEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// isBlockKey reports whether key lives below BlocksPrefix
+func isBlockKey(key ds.Key) bool {
+	return strings.HasPrefix(key.String(), BlocksPrefix.String()+"/")
+}
+
+// CorruptionError is returned by Get when the data stored for a
+// multihash-derived key does not hash to that key.
+type CorruptionError struct {
+	Key      ds.Key
+	Expected mh.Multihash
+	Actual   mh.Multihash
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("sqlds: data for %s is corrupt: hashes to %s, expected %s",
+		e.Key, e.Actual.B58String(), e.Expected.B58String())
+}
+
+// WithHashVerification makes Get rehash values stored directly below
+// prefix and compare the result with the multihash encoded in their key.
+// GetReader hashes them as they are read and fails the final Read instead.
+// Keys that do not decode as a base32 multihash are returned unchecked.
+func WithHashVerification(prefix ds.Key) Option {
+	return func(d *Datastore) {
+		d.verifyPrefix = &prefix
+	}
+}
+
+// HashMismatches returns the number of corrupt values detected by Get
+// since the datastore was created.
+func (d *Datastore) HashMismatches() uint64 {
+	return atomic.LoadUint64(&d.mismatches)
+}
+
+// KeyMultihash decodes the multihash a block key was derived from
+func KeyMultihash(key ds.Key) (mh.Multihash, error) {
+	buf, err := keyEncoding.DecodeString(key.BaseNamespace())
+	if err != nil {
+		return nil, err
+	}
+
+	return mh.Cast(buf)
+}
+
+func (d *Datastore) verify(key ds.Key, value []byte) error {
+	if err := checkHash(*d.verifyPrefix, key, value); err != nil {
+		atomic.AddUint64(&d.mismatches, 1)
+		return err
+	}
+
+	return nil
+}
+
+// Verify rehashes every value stored directly below prefix and passes the
+// corrupt ones to fn. It returns the number of values that were checked.
+func (d *Datastore) Verify(ctx context.Context, prefix ds.Key, fn func(*CorruptionError)) (int64, error) {
+	var checked int64
+	err := d.Walk(ctx, prefix.String(), func(key ds.Key, value []byte) error {
+		if !key.Parent().Equal(prefix) {
+			return nil
+		}
+
+		checked++
+		if err := checkHash(prefix, key, value); err != nil {
+			atomic.AddUint64(&d.mismatches, 1)
+			fn(err)
+		}
+
+		return ctx.Err()
+	})
+
+	return checked, err
+}
+
+// keyHash returns the multihash the value of key must hash to, or nil if
+// the key is not a multihash directly below prefix
+func keyHash(prefix, key ds.Key) (mh.Multihash, *mh.DecodedMultihash) {
+	if !key.Parent().Equal(prefix) {
+		return nil, nil
+	}
+
+	expected, err := KeyMultihash(key)
+	if err != nil {
+		return nil, nil
+	}
+
+	dec, err := mh.Decode(expected)
+	if err != nil {
+		return nil, nil
+	}
+
+	return expected, dec
+}
+
+func checkHash(prefix, key ds.Key, value []byte) *CorruptionError {
+	expected, dec := keyHash(prefix, key)
+	if expected == nil {
+		return nil
+	}
+
+	actual, err := mh.Sum(value, dec.Code, dec.Length)
+	if err != nil {
+		// unsupported hash function, nothing we can check
+		return nil
+	}
+
+	if string(actual) != string(expected) {
+		return &CorruptionError{Key: key, Expected: expected, Actual: actual}
+	}
+
+	return nil
+}
+
+// streamHashes are the hash functions a value can be checked against while
+// it is read; values hashed with others are collected and checked whole
+var streamHashes = map[uint64]func() hash.Hash{
+	mh.SHA1:     sha1.New,
+	mh.SHA2_256: sha256.New,
+	mh.SHA2_512: sha512.New,
+}
+
+// verifyReader hashes the value read from r and fails the read that would
+// return io.EOF with a CorruptionError if it does not match key
+func (d *Datastore) verifyReader(key ds.Key, r io.ReadCloser) io.ReadCloser {
+	expected, dec := keyHash(*d.verifyPrefix, key)
+	if expected == nil {
+		return r
+	}
+
+	vr := &verifyingReader{ReadCloser: r, d: d, key: key, expected: expected, dec: dec}
+	if newHash, ok := streamHashes[dec.Code]; ok {
+		vr.hash = newHash()
+	}
+
+	return vr
+}
+
+type verifyingReader struct {
+	io.ReadCloser
+	d        *Datastore
+	key      ds.Key
+	expected mh.Multihash
+	dec      *mh.DecodedMultihash
+
+	// hash is nil for hash functions not in streamHashes, whose input is
+	// collected in value instead
+	hash  hash.Hash
+	value []byte
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if r.hash != nil {
+		r.hash.Write(p[:n])
+	} else {
+		r.value = append(r.value, p[:n]...)
+	}
+
+	if err != io.EOF {
+		return n, err
+	}
+
+	if cerr := r.check(); cerr != nil {
+		atomic.AddUint64(&r.d.mismatches, 1)
+		return n, cerr
+	}
+
+	return n, io.EOF
+}
+
+func (r *verifyingReader) check() *CorruptionError {
+	if r.hash == nil {
+		return checkHash(*r.d.verifyPrefix, r.key, r.value)
+	}
+
+	sum := r.hash.Sum(nil)
+	if r.dec.Length > len(sum) {
+		return nil
+	}
+
+	actual, err := mh.Encode(sum[:r.dec.Length], r.dec.Code)
+	if err != nil {
+		return nil
+	}
+
+	if string(actual) != string(r.expected) {
+		return &CorruptionError{Key: r.key, Expected: r.expected, Actual: actual}
+	}
+
+	return nil
+}
@@ -0,0 +1,100 @@
+package sqlds_test
+
+import (
+	"context"
+	"testing"
+
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	mh "github.com/multiformats/go-multihash"
+	sqlds "github.com/whyrusleeping/sql-datastore"
+)
+
+func blockKey(t *testing.T, data []byte) ds.Key {
+	hash, err := mh.Sum(data, mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sqlds.CidKey(cid.NewCidV0(hash))
+}
+
+func TestHashVerification(t *testing.T) {
+	d, done := newDS(t, sqlds.WithHashVerification(sqlds.BlocksPrefix))
+	defer done()
+
+	data := []byte("some block data")
+	k := blockKey(t, data)
+	if err := d.Put(k, data); err != nil {
+		t.Fatal(err)
+	}
+
+	val, err := d.Get(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(val) != string(data) {
+		t.Fatal("value received on get wasnt what we expected:", val)
+	}
+
+	_, err = d.DB().Exec("UPDATE blocks SET data = $2 WHERE key = $1", k.String(), []byte("bit rot"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = d.Get(k)
+	cerr, ok := err.(*sqlds.CorruptionError)
+	if !ok {
+		t.Fatal("expected CorruptionError, got: ", err)
+	}
+	if !cerr.Key.Equal(k) {
+		t.Fatalf("corruption reported for %s, expected %s", cerr.Key, k)
+	}
+	if d.HashMismatches() != 1 {
+		t.Fatalf("expected 1 mismatch, got %d", d.HashMismatches())
+	}
+
+	// keys that are not multihashes are not checked
+	other := sqlds.BlocksPrefix.ChildString("not-a-hash")
+	if err := d.Put(other, data); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Get(other); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	var keys []ds.Key
+	for _, data := range []string{"one", "two", "three"} {
+		k := blockKey(t, []byte(data))
+		if err := d.Put(k, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, k)
+	}
+	if err := d.Put(sqlds.BlocksPrefix.ChildString("not-a-hash"), []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := d.DB().Exec("UPDATE blocks SET data = $2 WHERE key = $1", keys[1].String(), []byte("bit rot"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var corrupt []ds.Key
+	checked, err := d.Verify(context.Background(), sqlds.BlocksPrefix, func(cerr *sqlds.CorruptionError) {
+		corrupt = append(corrupt, cerr.Key)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checked != 4 {
+		t.Fatalf("expected 4 values checked, got %d", checked)
+	}
+	if len(corrupt) != 1 || !corrupt[0].Equal(keys[1]) {
+		t.Fatalf("expected %s to be reported, got %v", keys[1], corrupt)
+	}
+}
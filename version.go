@@ -0,0 +1,261 @@
+package sqlds
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// VersionQueries are the statements needed to keep the history of values.
+// Every write is recorded as a version: the value a Put stored, or a
+// deletion marker.
+type VersionQueries interface {
+	// RecordVersion inserts a version of key ($1) with value ($2) and
+	// deletion flag ($3), written at the database's current time
+	RecordVersion() string
+	// VersionAt selects value and deletion flag of the newest version of
+	// key ($1) written at or before $2
+	VersionAt() string
+	// Versions selects value, deletion flag and time of every version of
+	// key ($1), oldest first
+	Versions() string
+	// PruneVersions deletes the versions written before $1 that were
+	// superseded before $1 too, and deletion markers written before $1
+	PruneVersions() string
+	// SeedVersion records the current value of key ($1), if it has no
+	// version yet, as written at time $2
+	SeedVersion() string
+	// ShareHistory takes the history lock in shared mode until the end of
+	// the transaction
+	ShareHistory() string
+}
+
+// Version is a value a key held from Time on
+type Version struct {
+	Time time.Time
+	// Value is nil if the key was deleted
+	Value   []byte
+	Deleted bool
+}
+
+// VersionConfig configures value history
+type VersionConfig struct {
+	// Retention is how far back GetAt can look. Zero keeps every version.
+	Retention time.Duration
+	// PruneInterval is how often versions older than Retention are removed
+	// in the background
+	PruneInterval time.Duration
+}
+
+// DefaultVersionConfig keeps a month of history
+var DefaultVersionConfig = VersionConfig{
+	Retention:     30 * 24 * time.Hour,
+	PruneInterval: time.Hour,
+}
+
+type versions struct {
+	cfg  VersionConfig
+	stop chan struct{}
+}
+
+// WithVersioning records every value written by Put and every Delete in a
+// history table, in the same transaction, so that earlier values can be
+// read back with GetAt and listed with History. Values are mutable in
+// this mode: Put replaces the value of an existing key instead of leaving
+// it alone. The history of a key starts when it is first written with
+// this option, with the value it held until then. It cannot be combined
+// with WithEncryption, which would leave plaintext in the history, or with
+// WithChunking. The Datastore's Queries must implement VersionQueries.
+func WithVersioning(cfg VersionConfig) Option {
+	return func(d *Datastore) {
+		d.versions = &versions{cfg: cfg, stop: make(chan struct{})}
+	}
+}
+
+func (v *versions) start(d *Datastore) {
+	if v.cfg.Retention <= 0 || v.cfg.PruneInterval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(v.cfg.PruneInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				_, err := d.PruneHistory(time.Now().Add(-v.cfg.Retention))
+				if err != nil {
+					log.Printf("sqlds: pruning history: %s", err)
+				}
+			case <-v.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (v *versions) close() {
+	close(v.stop)
+}
+
+func (d *Datastore) versionQueries() (VersionQueries, error) {
+	if d.invalid != nil {
+		return nil, d.invalid
+	}
+
+	vq, ok := d.queries.(VersionQueries)
+	if !ok {
+		return nil, fmt.Errorf("sqlds: %T does not support versioning", d.queries)
+	}
+
+	return vq, nil
+}
+
+// recordVersion adds value, or a deletion marker if it is nil, to the
+// history of key if the write changed the table
+func (d *Datastore) recordVersion(e execer, key ds.Key, value []byte, result sql.Result) error {
+	if d.versions == nil {
+		return nil
+	}
+
+	vq, err := d.versionQueries()
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil || rows == 0 {
+		return err
+	}
+
+	if _, err := e.Exec(vq.ShareHistory()); err != nil {
+		return err
+	}
+
+	_, err = e.Exec(vq.RecordVersion(), key.String(), value, value == nil)
+	return err
+}
+
+// overwrite removes the row of key so that a Put can replace it, first
+// recording the value it held if the key has no history yet
+func (d *Datastore) overwrite(e execer, key ds.Key) error {
+	vq, err := d.versionQueries()
+	if err != nil {
+		return err
+	}
+
+	if _, err := e.Exec(vq.ShareHistory()); err != nil {
+		return err
+	}
+
+	// as in Snapshot, a value from before versioning has held since the
+	// epoch as far as the history knows
+	if _, err := e.Exec(vq.SeedVersion(), key.String(), time.Unix(0, 0).UTC()); err != nil {
+		return err
+	}
+
+	if d.dedup != nil {
+		_, err = d.deleteDedup(e, key)
+		return err
+	}
+
+	_, err = e.Exec(d.queries.Delete(), key.String())
+	return err
+}
+
+// GetAt returns the value key had at time t
+func (d *Datastore) GetAt(key ds.Key, t time.Time) (value []byte, err error) {
+	vq, err := d.versionQueries()
+	if err != nil {
+		return nil, err
+	}
+
+	err = d.read(func(db *sql.DB) error {
+		var deleted bool
+		switch err := db.QueryRow(vq.VersionAt(), key.String(), t.UTC()).Scan(&value, &deleted); err {
+		case sql.ErrNoRows:
+			return ds.ErrNotFound
+		case nil:
+			if deleted {
+				return ds.ErrNotFound
+			}
+			if value == nil {
+				value = []byte{}
+			}
+			return nil
+		default:
+			return err
+		}
+	})
+
+	return value, err
+}
+
+// History returns the recorded versions of key, oldest first
+func (d *Datastore) History(key ds.Key) ([]Version, error) {
+	vq, err := d.versionQueries()
+	if err != nil {
+		return nil, err
+	}
+
+	var history []Version
+	err = d.read(func(db *sql.DB) error {
+		history = nil
+
+		rows, err := db.Query(vq.Versions(), key.String())
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var v Version
+			if err := rows.Scan(&v.Value, &v.Deleted, &v.Time); err != nil {
+				return err
+			}
+			if v.Value == nil && !v.Deleted {
+				v.Value = []byte{}
+			}
+			history = append(history, v)
+		}
+
+		return rows.Err()
+	})
+
+	return history, err
+}
+
+// PruneHistory removes the versions that GetAt no longer needs to answer
+// for any time from before on, and returns how many were removed. Versions
+// needed by a snapshot are kept.
+func (d *Datastore) PruneHistory(before time.Time) (int64, error) {
+	vq, err := d.versionQueries()
+	if err != nil {
+		return 0, err
+	}
+
+	oldest, ok, err := d.oldestSnapshot()
+	if err != nil {
+		return 0, err
+	}
+	if ok && oldest.Before(before) {
+		before = oldest
+	}
+
+	var removed int64
+	err = d.guard(func() error {
+		result, err := d.db.Exec(vq.PruneVersions(), before.UTC())
+		if err != nil {
+			return err
+		}
+
+		removed, err = result.RowsAffected()
+		return err
+	})
+
+	return removed, err
+}
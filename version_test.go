@@ -0,0 +1,168 @@
+package sqlds_test
+
+import (
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	sqlds "github.com/whyrusleeping/sql-datastore"
+	"github.com/whyrusleeping/sql-datastore/postgres"
+)
+
+func TestVersioning(t *testing.T) {
+	d, done := newDS(t, sqlds.WithVersioning(sqlds.VersionConfig{}))
+	defer done()
+
+	key := ds.NewKey("/ipns/self")
+	write := func(value string) time.Time {
+		if err := d.Delete(key); err != nil && err != ds.ErrNotFound {
+			t.Fatal(err)
+		}
+		if value != "" {
+			if err := d.Put(key, []byte(value)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// keep the versions apart
+		time.Sleep(5 * time.Millisecond)
+		return time.Now()
+	}
+
+	before := time.Now()
+	time.Sleep(5 * time.Millisecond)
+	afterV1 := write("v1")
+	afterV2 := write("v2")
+	afterDelete := write("")
+	afterV3 := write("v3")
+
+	for at, want := range map[time.Time]string{afterV1: "v1", afterV2: "v2", afterV3: "v3"} {
+		got, err := d.GetAt(key, at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Fatalf("expected %s, got %s", want, got)
+		}
+	}
+
+	for _, at := range []time.Time{before, afterDelete} {
+		if _, err := d.GetAt(key, at); err != ds.ErrNotFound {
+			t.Fatal("expected ErrNotFound, got", err)
+		}
+	}
+
+	history, err := d.History(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// v1, delete, v2, delete, v3
+	if len(history) != 5 {
+		t.Fatalf("expected 5 versions, got %d", len(history))
+	}
+	if !history[1].Deleted || string(history[2].Value) != "v2" || history[4].Time.Before(history[0].Time) {
+		t.Fatalf("unexpected history: %+v", history)
+	}
+
+	// everything up to the last delete is superseded before afterDelete,
+	// and v3 is still needed
+	removed, err := d.PruneHistory(afterDelete)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 4 {
+		t.Fatalf("expected 4 versions pruned, got %d", removed)
+	}
+	if got, err := d.GetAt(key, afterV3); err != nil || string(got) != "v3" {
+		t.Fatal("pruning lost the current version", err)
+	}
+
+	// v3 is the newest version before now, so it is kept
+	if _, err := d.PruneHistory(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := d.GetAt(key, time.Now()); err != nil || string(got) != "v3" {
+		t.Fatal("pruning lost the current version", err)
+	}
+}
+
+func TestVersioningRecordsEmptyValues(t *testing.T) {
+	d, done := newDS(t, sqlds.WithVersioning(sqlds.VersionConfig{}))
+	defer done()
+
+	if err := d.Put(ds.NewKey("/empty"), []byte{}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := d.GetAt(ds.NewKey("/empty"), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Fatalf("expected an empty value, got %q", got)
+	}
+}
+
+func TestVersioningOverwrites(t *testing.T) {
+	d, done := newDS(t, sqlds.WithVersioning(sqlds.VersionConfig{}))
+	defer done()
+
+	key := ds.NewKey("/ipns/self")
+	if err := d.Put(key, []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	afterV1 := time.Now()
+	time.Sleep(5 * time.Millisecond)
+	if err := d.Put(key, []byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := d.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "v2" {
+		t.Fatalf("expected Put to replace the value, got %s", got)
+	}
+
+	history, err := d.History(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || string(history[0].Value) != "v1" || string(history[1].Value) != "v2" {
+		t.Fatalf("unexpected history: %+v", history)
+	}
+
+	for at, want := range map[time.Time]string{afterV1: "v1", time.Now(): "v2"} {
+		got, err := d.GetAt(key, at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Fatalf("expected %s, got %s", want, got)
+		}
+	}
+}
+
+func TestVersioningRecordsEarlierValue(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	key := ds.NewKey("/ipns/self")
+	if err := d.Put(key, []byte("before")); err != nil {
+		t.Fatal(err)
+	}
+
+	v := sqlds.NewDatastore(d.DB(), postgres.Queries{}, sqlds.WithVersioning(sqlds.VersionConfig{}))
+	if err := v.Put(key, []byte("after")); err != nil {
+		t.Fatal(err)
+	}
+
+	history, err := v.History(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || string(history[0].Value) != "before" || string(history[1].Value) != "after" {
+		t.Fatalf("unexpected history: %+v", history)
+	}
+}